@@ -0,0 +1,153 @@
+package connector
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"time"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+
+	"go.mau.fi/mautrix-meta/pkg/messagix/table"
+	"go.mau.fi/mautrix-meta/pkg/metaid"
+)
+
+type AIBotThreadMode string
+
+const (
+	AIBotThreadsBridge  AIBotThreadMode = "bridge"
+	AIBotThreadsHide    AIBotThreadMode = "hide"
+	AIBotThreadsExclude AIBotThreadMode = "exclude"
+)
+
+func (mode AIBotThreadMode) IsValid() bool {
+	switch mode {
+	case AIBotThreadsBridge, AIBotThreadsHide, AIBotThreadsExclude:
+		return true
+	default:
+		return false
+	}
+}
+
+const (
+	// aiStreamQuietPeriod is how long a bot response must go without updates before it's considered complete.
+	aiStreamQuietPeriod = 3 * time.Second
+	// aiStreamMaxWait is the maximum time a bot response is held back, even if it keeps being updated.
+	aiStreamMaxWait = 2 * time.Minute
+)
+
+// pendingAIMessage is a Meta AI response that is still being streamed.
+type pendingAIMessage struct {
+	evt      *FBMessageEvent
+	timer    *time.Timer
+	deadline time.Time
+}
+
+func (m *MetaClient) shouldCreateAIBotPortal(threadType table.ThreadType) bool {
+	return threadType != table.AI_BOT || m.Main.Config.AIBotThreads != AIBotThreadsExclude
+}
+
+// rememberAIBotThread records AI bot threads, so that messages in tables without thread info can be recognized
+// without a database lookup.
+func (m *MetaClient) rememberAIBotThread(threadKey int64, threadType table.ThreadType) {
+	if threadType == table.AI_BOT {
+		m.aiBotThreads.Store(threadKey, struct{}{})
+	}
+}
+
+func (m *MetaClient) isAIBotThread(threadType table.ThreadType, portalKey networkid.PortalKey) bool {
+	if threadType != table.UNKNOWN_THREAD_TYPE {
+		return threadType == table.AI_BOT
+	}
+	_, isAIBot := m.aiBotThreads.Load(metaid.ParseFBPortalID(portalKey.ID))
+	return isAIBot
+}
+
+// bufferAIMessage holds back a message from an AI bot until the response stops streaming,
+// so that it's bridged as a single final message instead of a message with dozens of edits.
+//
+// The message keeps its original timestamp, but it's bridged after any messages that arrived during
+// the quiet period, unless they're in the same chat (see flushAIMessagesInPortal).
+func (m *MetaClient) bufferAIMessage(ctx context.Context, evt *FBMessageEvent) {
+	m.aiStreamsLock.Lock()
+	defer m.aiStreamsLock.Unlock()
+	if pending, ok := m.aiStreams[evt.MessageId]; ok {
+		pending.evt = evt
+		m.extendAIStreamTimer(pending)
+		return
+	}
+	zerolog.Ctx(ctx).Debug().Str("message_id", evt.MessageId).Msg("Holding back AI bot response until it's complete")
+	pending := &pendingAIMessage{
+		evt:      evt,
+		deadline: time.Now().Add(aiStreamMaxWait),
+	}
+	pending.timer = time.AfterFunc(aiStreamQuietPeriod, func() {
+		m.flushAIMessage(evt.MessageId)
+	})
+	m.aiStreams[evt.MessageId] = pending
+}
+
+// updateBufferedAIMessage applies an edit to a bot response that hasn't been bridged yet.
+// The returned bool is false if the edit target isn't being held back.
+func (m *MetaClient) updateBufferedAIMessage(edit *table.LSEditMessage) bool {
+	m.aiStreamsLock.Lock()
+	defer m.aiStreamsLock.Unlock()
+	pending, ok := m.aiStreams[edit.MessageID]
+	if !ok {
+		return false
+	}
+	pending.evt.Text = edit.Text
+	m.extendAIStreamTimer(pending)
+	return true
+}
+
+func (m *MetaClient) extendAIStreamTimer(pending *pendingAIMessage) {
+	pending.timer.Reset(min(aiStreamQuietPeriod, time.Until(pending.deadline)))
+}
+
+// flushAIMessagesInPortal bridges any held back bot responses in the given chat immediately,
+// so that they stay in order with a new message in the same chat.
+func (m *MetaClient) flushAIMessagesInPortal(portalKey networkid.PortalKey, exceptMessageID string) {
+	m.aiStreamsLock.Lock()
+	var flush []*pendingAIMessage
+	for messageID, pending := range m.aiStreams {
+		if messageID != exceptMessageID && pending.evt.portalKey == portalKey {
+			pending.timer.Stop()
+			delete(m.aiStreams, messageID)
+			flush = append(flush, pending)
+		}
+	}
+	m.aiStreamsLock.Unlock()
+	slices.SortFunc(flush, func(a, b *pendingAIMessage) int {
+		return cmp.Compare(a.evt.TimestampMs, b.evt.TimestampMs)
+	})
+	for _, pending := range flush {
+		m.Main.Bridge.QueueRemoteEvent(m.UserLogin, pending.evt)
+	}
+}
+
+// stopAIStreams stops the timers of all held back bot responses. If flush is true, the responses are bridged
+// in their current state, otherwise they're dropped.
+func (m *MetaClient) stopAIStreams(flush bool) {
+	m.aiStreamsLock.Lock()
+	streams := m.aiStreams
+	m.aiStreams = make(map[string]*pendingAIMessage)
+	m.aiStreamsLock.Unlock()
+	for _, pending := range streams {
+		pending.timer.Stop()
+		if flush {
+			m.Main.Bridge.QueueRemoteEvent(m.UserLogin, pending.evt)
+		}
+	}
+}
+
+func (m *MetaClient) flushAIMessage(messageID string) {
+	m.aiStreamsLock.Lock()
+	pending, ok := m.aiStreams[messageID]
+	delete(m.aiStreams, messageID)
+	m.aiStreamsLock.Unlock()
+	if ok {
+		m.Main.Bridge.QueueRemoteEvent(m.UserLogin, pending.evt)
+	}
+}
@@ -25,6 +25,7 @@ type BackfillCollector struct {
 	MaxMessages int
 	Forward     bool
 	Anchor      *database.Message
+	SyncGroup   int64
 	Done        func()
 }
 
@@ -70,7 +71,7 @@ func (m *MetaClient) handleUpsertMessages(tk handlerParams, upsert *table.Upsert
 			Bool("existing_messages_reached", existingMessagesReached)
 		if !messageLimitReached && !endOfChatReached && !existingMessagesReached {
 			logEvt.Msg("Requesting more history as collector still has room")
-			go m.requestMoreHistory(ctx, tk.ID, upsert.Range.MinTimestampMs, upsert.Range.MinMessageId)
+			go m.requestMoreHistory(ctx, tk.ID, collector.SyncGroup, upsert.Range.MinTimestampMs, upsert.Range.MinMessageId)
 			return nil
 		}
 		logEvt.Msg("Processing collected history now")
@@ -125,14 +126,14 @@ func (m *MetaClient) handleUpdateExistingMessageRange(tk handlerParams, rng *tab
 	return nil
 }
 
-func (m *MetaClient) requestMoreHistory(ctx context.Context, threadID, minTimestampMS int64, minMessageID string) bool {
+func (m *MetaClient) requestMoreHistory(ctx context.Context, threadID, syncGroup, minTimestampMS int64, minMessageID string) bool {
 	resp, err := m.Client.ExecuteTasks(&socket.FetchMessagesTask{
 		ThreadKey:            threadID,
 		Direction:            0,
 		ReferenceTimestampMs: minTimestampMS,
 		ReferenceMessageId:   minMessageID,
-		SyncGroup:            1,
-		Cursor:               m.Client.SyncManager.GetCursor(1),
+		SyncGroup:            syncGroup,
+		Cursor:               m.Client.SyncManager.GetCursor(syncGroup),
 	})
 	zerolog.Ctx(ctx).Trace().
 		Int64("thread_id", threadID).
@@ -175,9 +176,15 @@ func (m *MetaClient) FetchMessages(ctx context.Context, params bridgev2.FetchMes
 	if m.Client == nil || m.Client.SyncManager == nil {
 		return nil, bridgev2.ErrNotLoggedIn
 	}
-	if params.Portal.Metadata.(*metaid.PortalMetadata).ThreadType == table.ENCRYPTED_OVER_WA_GROUP {
+	threadType := params.Portal.Metadata.(*metaid.PortalMetadata).ThreadType
+	if threadType == table.ENCRYPTED_OVER_WA_GROUP {
 		return nil, nil
 	}
+	syncGroup := int64(1)
+	if threadType == table.COMMUNITY_GROUP {
+		// Community chats live in a separate sync group, so gaps must be filled from there
+		syncGroup = 104
+	}
 	threadID := metaid.ParseFBPortalID(params.Portal.ID)
 	if threadID == 0 {
 		return nil, fmt.Errorf("invalid thread ID")
@@ -194,7 +201,11 @@ func (m *MetaClient) FetchMessages(ctx context.Context, params bridgev2.FetchMes
 			oldestMessageID = upsert.Range.MinMessageId
 			oldestMessageTS = upsert.Range.MinTimestampMs
 		} else if params.AnchorMessage != nil {
-			parsedID, ok := metaid.ParseMessageID(params.AnchorMessage.ID).(metaid.ParsedFBMessageID)
+			anchorID, err := m.resolveMessageID(params.AnchorMessage.ID)
+			if err != nil {
+				return nil, err
+			}
+			parsedID, ok := anchorID.(metaid.ParsedFBMessageID)
 			if !ok {
 				zerolog.Ctx(ctx).Warn().Msg("Can't backfill with non-FB message ID")
 				return nil, nil
@@ -224,6 +235,7 @@ func (m *MetaClient) FetchMessages(ctx context.Context, params bridgev2.FetchMes
 			MaxMessages:    params.Count,
 			Forward:        params.Forward,
 			Anchor:         params.AnchorMessage,
+			SyncGroup:      syncGroup,
 			Done: sync.OnceFunc(func() {
 				close(doneCh)
 			}),
@@ -231,7 +243,7 @@ func (m *MetaClient) FetchMessages(ctx context.Context, params bridgev2.FetchMes
 		if !m.addBackfillCollector(threadID, collector) {
 			return nil, fmt.Errorf("backfill collector already exists for thread %d", threadID)
 		}
-		m.requestMoreHistory(ctx, threadID, oldestMessageTS, oldestMessageID)
+		m.requestMoreHistory(ctx, threadID, syncGroup, oldestMessageTS, oldestMessageID)
 		select {
 		case <-doneCh:
 			upsert = collector.UpsertMessages
@@ -264,6 +276,21 @@ func (m *MetaClient) wrapBackfillEvents(ctx context.Context, portal *bridgev2.Po
 		}
 		return false
 	})
+	if forward {
+		upsert.Messages = slices.DeleteFunc(upsert.Messages, func(msg *table.WrappedMessage) bool {
+			if m.getPendingEcho(msg.OfflineThreadingId) == nil {
+				return false
+			}
+			// Echoes of messages sent from Matrix are handled as live events to patch the already bridged message.
+			// This must happen before anchor filtering, as the sent message may have a later local timestamp.
+			m.Main.Bridge.QueueRemoteEvent(m.UserLogin, &FBMessageEvent{
+				WrappedMessage: msg,
+				portalKey:      portal.PortalKey,
+				m:              m,
+			})
+			return true
+		})
+	}
 	if anchor != nil {
 		if forward {
 			upsert.Messages = slices.DeleteFunc(upsert.Messages, func(message *table.WrappedMessage) bool {
@@ -276,11 +303,21 @@ func (m *MetaClient) wrapBackfillEvents(ctx context.Context, portal *bridgev2.Po
 		}
 	}
 	wrappedMessages := make([]*bridgev2.BackfillMessage, len(upsert.Messages))
+	var editChains []*pendingEditChain
 	for i, msg := range upsert.Messages {
 		m.handleSubthread(ctx, msg)
 		log := zerolog.Ctx(ctx).With().Str("message_id", msg.MessageId).Logger()
 		ctx := log.WithContext(ctx)
 		sender := m.makeEventSender(msg.SenderId)
+		if msg.EditCount > 0 && forward {
+			if chain := m.rewindEditHistory(ctx, portal, msg, sender); chain != nil {
+				editChains = append(editChains, chain)
+			}
+		} else if msg.EditCount > 0 {
+			// Backwards backfill isn't run in the portal event loop, so there's no way to send the edits
+			// after the batch. Old messages are bridged with only the latest text instead.
+			m.discardEditHistory(ctx, msg.MessageId)
+		}
 		intent := portal.GetIntentFor(ctx, sender, m.UserLogin, bridgev2.RemoteEventBackfill)
 		wrappedMessages[i] = &bridgev2.BackfillMessage{
 			ConvertedMessage: m.Main.MsgConv.ToMatrix(ctx, portal, m.Client, intent, msg, m.Main.Config.DisableXMABackfill || m.Main.Config.DisableXMAAlways),
@@ -299,6 +336,7 @@ func (m *MetaClient) wrapBackfillEvents(ctx context.Context, portal *bridgev2.Po
 			}
 		}
 	}
+	m.queueEditChains(editChains)
 	return &bridgev2.FetchMessagesResponse{
 		Messages: wrappedMessages,
 		HasMore:  upsert.Range.HasMoreBefore,
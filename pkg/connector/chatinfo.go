@@ -8,6 +8,7 @@ import (
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"go.mau.fi/util/ptr"
+	"go.mau.fi/whatsmeow/proto/waMsgApplication"
 	"go.mau.fi/whatsmeow/types"
 	"maunium.net/go/mautrix/bridgev2"
 	"maunium.net/go/mautrix/bridgev2/database"
@@ -21,7 +22,11 @@ import (
 
 func (m *MetaClient) GetChatInfo(ctx context.Context, portal *bridgev2.Portal) (*bridgev2.ChatInfo, error) {
 	meta := portal.Metadata.(*metaid.PortalMetadata)
-	if !meta.ThreadType.IsWhatsApp() {
+	if meta.ThreadType.IsCommunitySpace() {
+		// Community spaces may need to be created before their own thread info arrives
+		// when a child room is added to them, so build the info from the member list.
+		return m.getCommunityChatInfo(ctx, metaid.ParseFBPortalID(portal.ID), meta.ThreadType)
+	} else if !meta.ThreadType.IsWhatsApp() {
 		return nil, fmt.Errorf("getting chat info for non-whatsapp threads is not supported")
 	}
 	jid := meta.JID(portal.ID)
@@ -133,15 +138,21 @@ func (m *MetaClient) makeMinimalChatInfo(threadID int64, threadType table.Thread
 	}
 
 	roomType := database.RoomTypeDefault
-	if threadType.IsOneToOne() {
+	if threadType.IsCommunitySpace() {
+		roomType = database.RoomTypeSpace
+	} else if threadType.IsOneToOne() {
 		roomType = database.RoomTypeDM
 		members.OtherUserID = metaid.MakeUserID(threadID)
 		members.IsFull = true
 		if metaid.MakeUserLoginID(threadID) != m.UserLogin.ID {
-			members.MemberMap[members.OtherUserID] = bridgev2.ChatMember{
+			member := bridgev2.ChatMember{
 				EventSender: m.makeEventSender(threadID),
 				Membership:  event.MembershipJoin,
 			}
+			if threadType == table.AI_BOT {
+				member.UserInfo = &bridgev2.UserInfo{IsBot: ptr.Ptr(true)}
+			}
+			members.MemberMap[members.OtherUserID] = member
 		} else {
 			members.MemberMap = makeNoteToSelfMembers(members.OtherUserID, nil)
 		}
@@ -149,7 +160,7 @@ func (m *MetaClient) makeMinimalChatInfo(threadID int64, threadType table.Thread
 	return &bridgev2.ChatInfo{
 		Members:     members,
 		Type:        &roomType,
-		CanBackfill: !threadType.IsWhatsApp(),
+		CanBackfill: !threadType.IsWhatsApp() && !threadType.IsCommunitySpace(),
 		ExtraUpdates: func(ctx context.Context, portal *bridgev2.Portal) (changed bool) {
 			meta := portal.Metadata.(*metaid.PortalMetadata)
 			if threadType == table.GROUP_THREAD && meta.ThreadType > 15 {
@@ -197,6 +208,8 @@ func (m *MetaClient) makeWADirectChatInfo(recipient types.JID) *bridgev2.ChatInf
 	}
 }
 
+const marketplaceTopic = "Facebook Marketplace conversation"
+
 func (m *MetaClient) wrapChatInfo(tbl table.ThreadInfo) *bridgev2.ChatInfo {
 	chatInfo := m.makeMinimalChatInfo(tbl.GetThreadKey(), tbl.GetThreadType())
 	if *chatInfo.Type != database.RoomTypeDM {
@@ -210,21 +223,85 @@ func (m *MetaClient) wrapChatInfo(tbl table.ThreadInfo) *bridgev2.ChatInfo {
 	if chatInfo.UserLocal == nil {
 		chatInfo.UserLocal = &bridgev2.UserLocalPortalInfo{}
 	}
+	if tbl.GetThreadType() == table.MARKETPLACE {
+		chatInfo.Topic = ptr.Ptr(marketplaceTopic)
+		if m.Main.Config.MarketplaceTag != "" {
+			chatInfo.UserLocal.Tag = ptr.Ptr(event.RoomTag(m.Main.Config.MarketplaceTag))
+		}
+	}
+	if tbl.GetThreadType() == table.AI_BOT {
+		if m.Main.Config.AIBotThreads == AIBotThreadsHide {
+			chatInfo.UserLocal.Tag = ptr.Ptr(event.RoomTagLowPriority)
+		}
+		// AI bots often don't have a contact entry, so name the ghost after the thread
+		if bot, ok := chatInfo.Members.MemberMap[chatInfo.Members.OtherUserID]; ok && bot.UserInfo != nil && tbl.GetThreadName() != "" {
+			bot.UserInfo.Name = ptr.Ptr(m.Main.Config.FormatDisplayname(DisplaynameParams{
+				DisplayName: tbl.GetThreadName(),
+				ID:          tbl.GetThreadKey(),
+			}))
+		}
+	}
 	if tbl.GetFolderName() == folderE2EECutover {
 		chatInfo.ExtraUpdates = bridgev2.MergeExtraUpdaters(chatInfo.ExtraUpdates, markPortalAsEncrypted)
 	}
-	dtit, ok := tbl.(*table.LSDeleteThenInsertThread)
-	if ok {
-		chatInfo.Members.TotalMemberCount = int(dtit.MemberCount)
-		if dtit.MuteExpireTimeMs < 0 {
+	switch typedTbl := tbl.(type) {
+	case *table.LSDeleteThenInsertThread:
+		chatInfo.Members.TotalMemberCount = int(typedTbl.MemberCount)
+		if typedTbl.MuteExpireTimeMs < 0 {
 			chatInfo.UserLocal.MutedUntil = ptr.Ptr(event.MutedForever)
-		} else if dtit.MuteExpireTimeMs > 0 {
-			chatInfo.UserLocal.MutedUntil = ptr.Ptr(time.UnixMilli(dtit.MuteExpireTimeMs))
+		} else if typedTbl.MuteExpireTimeMs > 0 {
+			chatInfo.UserLocal.MutedUntil = ptr.Ptr(time.UnixMilli(typedTbl.MuteExpireTimeMs))
+		}
+		if !typedTbl.ThreadType.IsWhatsApp() {
+			chatInfo.Disappear = wrapDisappearingSetting(typedTbl.DisappearingSettingTtl)
+		}
+		chatInfo.ExtraUpdates = bridgev2.MergeExtraUpdaters(
+			chatInfo.ExtraUpdates,
+			updateCannotUnsendReason(table.MessageUnsendabilityStatus(typedTbl.CannotUnsendReason)),
+		)
+		if typedTbl.ParentThreadKey > 0 && typedTbl.ThreadType != table.COMMUNITY_SUB_THREAD {
+			// Community chats and categories point at the community folder (or category) they're in,
+			// which are bridged as spaces.
+			chatInfo.ParentID = ptr.Ptr(metaid.MakeFBPortalID(typedTbl.ParentThreadKey))
 		}
 	}
 	return chatInfo
 }
 
+func updateCannotUnsendReason(reason table.MessageUnsendabilityStatus) func(context.Context, *bridgev2.Portal) bool {
+	return func(ctx context.Context, portal *bridgev2.Portal) bool {
+		meta := portal.Metadata.(*metaid.PortalMetadata)
+		if meta.CannotUnsendReason == reason {
+			return false
+		}
+		meta.CannotUnsendReason = reason
+		return true
+	}
+}
+
+// wrapDisappearingSetting converts the disappearing message TTL of a Messenger thread.
+// Vanish mode isn't a timer (messages are removed when the chat is closed), so it isn't reflected
+// in the portal setting. Vanish mode messages still expire based on their own ephemeral duration.
+func wrapDisappearingSetting(ttl int64) *database.DisappearingSetting {
+	if ttl > 0 {
+		return &database.DisappearingSetting{
+			Type:  database.DisappearingTypeAfterRead,
+			Timer: time.Duration(ttl) * time.Second,
+		}
+	}
+	return &database.DisappearingSetting{}
+}
+
+func wrapWAEphemeralSetting(setting *waMsgApplication.MessageApplication_EphemeralSetting) database.DisappearingSetting {
+	if setting.GetEphemeralExpiration() == 0 || setting.GetIsEphemeralSettingReset() {
+		return database.DisappearingSetting{}
+	}
+	return database.DisappearingSetting{
+		Type:  database.DisappearingTypeAfterRead,
+		Timer: time.Duration(setting.GetEphemeralExpiration()) * time.Second,
+	}
+}
+
 func (m *MetaClient) wrapChatMember(tbl *table.LSAddParticipantIdToGroupThread) bridgev2.ChatMember {
 	var power int
 	if tbl.IsSuperAdmin {
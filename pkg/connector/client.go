@@ -41,7 +41,25 @@ type MetaClient struct {
 	backfillCollectors map[int64]*BackfillCollector
 	backfillLock       sync.Mutex
 
+	pendingReactionSyncs    sync.Map
+	pendingParticipantSyncs sync.Map
+	pendingCommunitySyncs   sync.Map
+	pendingHoleDetections   sync.Map
+	pendingProfileFetches   sync.Map
+
+	outgoingInFlight  map[int64]struct{}
+	outgoingLock      sync.Mutex
+	flushOutgoingLock sync.Mutex
+	pendingEchoes     map[string]*pendingEcho
+	pendingEchoesLock sync.Mutex
+	aiStreams         map[string]*pendingAIMessage
+	aiStreamsLock     sync.Mutex
+	aiBotThreads      sync.Map
+
 	stopPeriodicReconnect atomic.Pointer[context.CancelFunc]
+	stopIdleLoop          atomic.Pointer[context.CancelFunc]
+	lastActivity          atomic.Int64
+	pushSleeping          atomic.Bool
 	lastFullReconnect     time.Time
 	connectWaiter         *exsync.Event
 	e2eeConnectWaiter     *exsync.Event
@@ -69,6 +87,9 @@ func (m *MetaConnector) LoadUserLogin(ctx context.Context, login *bridgev2.UserL
 
 		incomingTables:     make(chan *table.LSTable, 16),
 		backfillCollectors: make(map[int64]*BackfillCollector),
+		outgoingInFlight:   make(map[int64]struct{}),
+		pendingEchoes:      make(map[string]*pendingEcho),
+		aiStreams:          make(map[string]*pendingAIMessage),
 
 		connectWaiter:     exsync.NewEvent(),
 		e2eeConnectWaiter: exsync.NewEvent(),
@@ -215,6 +236,9 @@ func (m *MetaClient) connectWithTable(ctx context.Context, initialTable *table.L
 	}
 
 	go m.periodicReconnect()
+	if m.Main.Config.PushWakeup {
+		go m.idleDisconnectLoop()
+	}
 
 	return nil
 }
@@ -294,6 +318,7 @@ func (m *MetaClient) connectE2EE() error {
 }
 
 func (m *MetaClient) Disconnect() {
+	m.stopAIStreams(true)
 	if cli := m.Client; cli != nil {
 		cli.Disconnect()
 		m.Client = nil
@@ -310,6 +335,10 @@ func (m *MetaClient) Disconnect() {
 	if stopPeriodicReconnect := m.stopPeriodicReconnect.Swap(nil); stopPeriodicReconnect != nil {
 		(*stopPeriodicReconnect)()
 	}
+	if stopIdleLoop := m.stopIdleLoop.Swap(nil); stopIdleLoop != nil {
+		(*stopIdleLoop)()
+	}
+	m.pushSleeping.Store(false)
 }
 
 var metaCaps = &bridgev2.NetworkRoomCapabilities{
@@ -349,6 +378,8 @@ func (m *MetaClient) IsThisUser(ctx context.Context, userID networkid.UserID) bo
 }
 
 func (m *MetaClient) LogoutRemote(ctx context.Context) {
+	// The login is being deleted, so there's no point in bridging incomplete bot responses
+	m.stopAIStreams(false)
 	m.Disconnect()
 	if dev := m.WADevice; dev != nil {
 		err := dev.Delete()
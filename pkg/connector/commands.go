@@ -1,8 +1,14 @@
 package connector
 
 import (
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
+	"go.mau.fi/util/exfmt"
+	"go.mau.fi/whatsmeow/types"
+
 	"maunium.net/go/mautrix/bridgev2/commands"
 	"maunium.net/go/mautrix/bridgev2/database"
 
@@ -84,3 +90,146 @@ func fnToggleEncryption(ce *commands.Event) {
 		ce.Log.Err(err).Msg("Failed to update portal in database")
 	}
 }
+
+var cmdSetDisappearingTimer = &commands.FullHandler{
+	Func:    fnSetDisappearingTimer,
+	Name:    "disappearing-timer",
+	Aliases: []string{"disappear-timer"},
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionChats,
+		Description: "Set the disappearing message timer in the current encrypted chat",
+		Args:        "<_duration_|off>",
+	},
+	RequiresPortal: true,
+	RequiresLogin:  true,
+}
+
+// waDisappearingTimers are the timers that WhatsApp clients allow in encrypted chats.
+var waDisappearingTimers = []time.Duration{24 * time.Hour, 7 * 24 * time.Hour, 90 * 24 * time.Hour}
+
+func parseDisappearingTimer(arg string, allowed []time.Duration) (time.Duration, bool) {
+	arg = strings.ToLower(arg)
+	switch arg {
+	case "off", "disable", "0":
+		return 0, true
+	}
+	var dur time.Duration
+	if days, found := strings.CutSuffix(arg, "d"); found {
+		dayCount, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, false
+		}
+		dur = time.Duration(dayCount) * 24 * time.Hour
+	} else {
+		var err error
+		dur, err = time.ParseDuration(arg)
+		if err != nil {
+			return 0, false
+		}
+	}
+	return dur, slices.Contains(allowed, dur)
+}
+
+func formatDisappearingTimers(timers []time.Duration) string {
+	formatted := make([]string, len(timers))
+	for i, timer := range timers {
+		formatted[i] = exfmt.Duration(timer)
+	}
+	return strings.Join(formatted, ", ")
+}
+
+func fnSetDisappearingTimer(ce *commands.Event) {
+	allowed := waDisappearingTimers
+	if len(ce.Args) == 0 {
+		ce.Reply("Usage: `$cmdprefix disappearing-timer <duration|off>`. Allowed durations: %s", formatDisappearingTimers(allowed))
+		return
+	}
+	timer, ok := parseDisappearingTimer(ce.Args[0], allowed)
+	if !ok {
+		ce.Reply("Invalid duration %q. Allowed durations: %s", ce.Args[0], formatDisappearingTimers(allowed))
+		return
+	}
+	meta := ce.Portal.Metadata.(*metaid.PortalMetadata)
+	if !meta.ThreadType.IsWhatsApp() {
+		// The Messenger task for changing the timer hasn't been confirmed from a captured payload yet
+		ce.Reply("Disappearing message timers can only be changed in encrypted chats")
+		return
+	}
+	login, _, err := ce.Portal.FindPreferredLogin(ce.Ctx, ce.User, false)
+	if err != nil {
+		ce.Reply("Failed to find login for room")
+		ce.Log.Err(err).Msg("Failed to find login for room")
+		return
+	}
+	cli := login.Client.(*MetaClient)
+	if cli.E2EEClient == nil {
+		ce.Reply("Not connected to encrypted chats")
+		return
+	}
+	jid := meta.JID(ce.Portal.ID)
+	if jid.Server == types.GroupServer {
+		err = cli.E2EEClient.SetDisappearingTimer(jid, timer)
+		if err != nil {
+			ce.Log.Err(err).Msg("Failed to set disappearing timer")
+			ce.Reply("Failed to set disappearing timer: %v", err)
+			return
+		}
+	}
+	// In direct chats, the new timer is sent as metadata in the next message
+	meta.EphemeralSettingTS = time.Now().Unix()
+	setting := database.DisappearingSetting{Timer: timer}
+	if timer > 0 {
+		setting.Type = database.DisappearingTypeAfterRead
+	}
+	if ce.Portal.UpdateDisappearingSetting(ce.Ctx, setting, nil, time.Now(), false, true) {
+		return
+	} else if timer == 0 {
+		ce.Reply("Disappearing messages are already disabled")
+	} else {
+		ce.Reply("Disappearing timer is already set to %s", exfmt.Duration(timer))
+	}
+}
+
+var cmdDeleteThread = &commands.FullHandler{
+	Func: fnDeleteThread,
+	Name: "delete-thread",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionChats,
+		Description: "Delete the community sub-thread started from the replied-to message",
+	},
+	RequiresPortal: true,
+	RequiresLogin:  true,
+}
+
+func fnDeleteThread(ce *commands.Event) {
+	meta := ce.Portal.Metadata.(*metaid.PortalMetadata)
+	if meta.ThreadType != table.COMMUNITY_GROUP {
+		ce.Reply("Threads can only be deleted in community chats")
+		return
+	} else if ce.ReplyTo == "" {
+		ce.Reply("Reply to the root message of a thread to delete it")
+		return
+	}
+	root, err := ce.Bridge.DB.Message.GetPartByMXID(ce.Ctx, ce.ReplyTo)
+	if err != nil {
+		ce.Log.Err(err).Msg("Failed to get thread root message")
+		ce.Reply("Failed to get thread root message")
+		return
+	} else if root == nil || root.Room != ce.Portal.PortalKey {
+		ce.Reply("Thread root message not found")
+		return
+	}
+	login, _, err := ce.Portal.FindPreferredLogin(ce.Ctx, ce.User, false)
+	if err != nil {
+		ce.Reply("Failed to find login for room")
+		ce.Log.Err(err).Msg("Failed to find login for room")
+		return
+	}
+	err = login.Client.(*MetaClient).deleteCommunitySubThread(ce.Ctx, root)
+	if err != nil {
+		ce.Log.Err(err).Msg("Failed to delete thread")
+		ce.Reply("Failed to delete thread: %v", err)
+		return
+	}
+	ce.Reply("Thread deleted")
+}
@@ -0,0 +1,414 @@
+package connector
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/rs/zerolog"
+	"go.mau.fi/util/ptr"
+	"golang.org/x/exp/maps"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/bridgev2/simplevent"
+	"maunium.net/go/mautrix/event"
+
+	"go.mau.fi/mautrix-meta/pkg/messagix/methods"
+	"go.mau.fi/mautrix-meta/pkg/messagix/socket"
+	"go.mau.fi/mautrix-meta/pkg/messagix/table"
+	"go.mau.fi/mautrix-meta/pkg/metaid"
+)
+
+// maxCommunityMemberPages limits how many pages of members are fetched for a single community.
+const maxCommunityMemberPages = 50
+
+func (m *MetaClient) wrapCommunityMember(contactID int64, name, avatarURL, nickname string, isAdmin, isModerator bool) bridgev2.ChatMember {
+	var power int
+	if isAdmin {
+		power = 75
+	} else if isModerator {
+		power = 50
+	}
+	member := bridgev2.ChatMember{
+		EventSender: m.makeEventSender(contactID),
+		Membership:  event.MembershipJoin,
+		PowerLevel:  &power,
+	}
+	if nickname != "" {
+		member.Nickname = &nickname
+	}
+	if name != "" {
+		member.UserInfo = &bridgev2.UserInfo{
+			Name: ptr.Ptr(m.Main.Config.FormatDisplayname(DisplaynameParams{
+				DisplayName: name,
+				ID:          contactID,
+			})),
+		}
+		if avatarURL != "" {
+			member.UserInfo.Avatar = wrapAvatar(avatarURL)
+		}
+	}
+	return member
+}
+
+// fetchCommunityMembers fetches the full member list of a community using the member list task.
+// The returned bool is true if all pages were fetched.
+func (m *MetaClient) fetchCommunityMembers(ctx context.Context, communityID int64) (map[networkid.UserID]bridgev2.ChatMember, bool, error) {
+	log := zerolog.Ctx(ctx).With().Int64("community_id", communityID).Logger()
+	members := make(map[networkid.UserID]bridgev2.ChatMember)
+	var cursor string
+	for page := 0; page < maxCommunityMemberPages; page++ {
+		resp, err := m.Client.ExecuteTasks(&socket.FetchCommunityMemberList{
+			CommunityID: communityID,
+			Roles:       []int{0},
+			Cursor:      cursor,
+			Source:      7,
+			ThreadRoles: []int{},
+		})
+		if err != nil {
+			return members, false, fmt.Errorf("failed to fetch page %d of member list: %w", page+1, err)
+		}
+		log.Trace().Any("response", resp).Int("page", page+1).Msg("Community member list response")
+		for _, member := range resp.LSInsertCommunityMember {
+			if member.CommunityID != communityID {
+				continue
+			}
+			members[metaid.MakeUserID(member.ContactID)] = m.wrapCommunityMember(
+				member.ContactID, member.Name, member.ProfilePictureURL, member.Nickname, member.IsAdmin, member.IsModerator,
+			)
+		}
+		hasMore := false
+		for _, rng := range resp.LSUpsertCommunityMemberRanges {
+			if rng.CommunityID == communityID && rng.HasMoreAfter && rng.NextPageCursor != "" && rng.NextPageCursor != cursor {
+				hasMore = true
+				cursor = rng.NextPageCursor
+			}
+		}
+		if !hasMore {
+			return members, true, nil
+		}
+	}
+	log.Warn().Int("member_count", len(members)).Msg("Community member list page limit reached")
+	return members, false, nil
+}
+
+func (m *MetaClient) makeCommunityMemberList(ctx context.Context, communityID int64) (*bridgev2.ChatMemberList, error) {
+	members, isFull, err := m.fetchCommunityMembers(ctx, communityID)
+	if err != nil && len(members) == 0 {
+		return nil, err
+	} else if err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Msg("Failed to fetch full community member list")
+		isFull = false
+	}
+	selfEvtSender := m.selfEventSender()
+	if _, hasSelf := members[selfEvtSender.Sender]; !hasSelf {
+		members[selfEvtSender.Sender] = bridgev2.ChatMember{
+			EventSender: selfEvtSender,
+			Membership:  event.MembershipJoin,
+		}
+	}
+	return &bridgev2.ChatMemberList{
+		IsFull:    isFull,
+		MemberMap: members,
+	}, nil
+}
+
+func (m *MetaClient) getCommunityChatInfo(ctx context.Context, threadKey int64, threadType table.ThreadType) (*bridgev2.ChatInfo, error) {
+	chatInfo := m.makeMinimalChatInfo(threadKey, threadType)
+	if threadType != table.COMMUNITY_FOLDER {
+		return chatInfo, nil
+	}
+	members, err := m.makeCommunityMemberList(ctx, threadKey)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Int64("community_id", threadKey).Msg("Failed to fetch community members")
+	} else {
+		chatInfo.Members = members
+	}
+	return chatInfo, nil
+}
+
+// maybeSyncCommunityMembers resyncs the member list of a community if the community is new
+// or its member count has changed since the last sync.
+func (m *MetaClient) maybeSyncCommunityMembers(ctx context.Context, thread *table.LSDeleteThenInsertThread) {
+	portal, err := m.Main.Bridge.GetExistingPortalByKey(ctx, m.makeFBPortalKey(thread.ThreadKey, table.COMMUNITY_FOLDER))
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Int64("community_id", thread.ThreadKey).Msg("Failed to get community portal")
+		return
+	} else if portal != nil && portal.MXID != "" && portal.Metadata.(*metaid.PortalMetadata).CommunityMemberCount == thread.MemberCount {
+		return
+	}
+	if _, alreadyPending := m.pendingCommunitySyncs.LoadOrStore(thread.ThreadKey, struct{}{}); alreadyPending {
+		return
+	}
+	ctx = context.WithoutCancel(ctx)
+	go func() {
+		defer m.pendingCommunitySyncs.Delete(thread.ThreadKey)
+		m.syncCommunityMembers(ctx, thread.ThreadKey, thread.MemberCount)
+	}()
+}
+
+// syncCommunityMembers fetches the member list of a community and resyncs the members of the space.
+func (m *MetaClient) syncCommunityMembers(ctx context.Context, communityID, memberCount int64) {
+	log := zerolog.Ctx(ctx).With().
+		Str("action", "sync community members").
+		Int64("community_id", communityID).
+		Logger()
+	ctx = log.WithContext(ctx)
+	members, err := m.makeCommunityMemberList(ctx, communityID)
+	if err != nil {
+		log.Err(err).Msg("Failed to fetch community members")
+		return
+	}
+	log.Debug().Int("member_count", len(members.MemberMap)).Msg("Fetched community members")
+	m.Main.Bridge.QueueRemoteEvent(m.UserLogin, &simplevent.ChatResync{
+		EventMeta: simplevent.EventMeta{
+			Type: bridgev2.RemoteEventChatResync,
+			LogContext: func(c zerolog.Context) zerolog.Context {
+				return c.Int64("community_id", communityID)
+			},
+			PortalKey: m.makeFBPortalKey(communityID, table.COMMUNITY_FOLDER),
+		},
+		ChatInfo: &bridgev2.ChatInfo{
+			Members: members,
+			ExtraUpdates: bridgev2.MergeExtraUpdaters(
+				m.nicknameUpdater(maps.Values(members.MemberMap)),
+				updateCommunityMemberCount(memberCount),
+			),
+		},
+	})
+}
+
+func updateCommunityMemberCount(count int64) func(context.Context, *bridgev2.Portal) bool {
+	return func(ctx context.Context, portal *bridgev2.Portal) bool {
+		meta := portal.Metadata.(*metaid.PortalMetadata)
+		if meta.CommunityMemberCount == count {
+			return false
+		}
+		meta.CommunityMemberCount = count
+		return true
+	}
+}
+
+// handleThreadTQSeqID tracks the thread queue sequence IDs of community threads
+// and runs hole detection if any sequence IDs were skipped.
+func (m *MetaClient) handleThreadTQSeqID(ctx context.Context, evt *table.LSUpdateThreadTQSeqID) {
+	log := zerolog.Ctx(ctx).With().
+		Int64("thread_id", evt.ThreadKey).
+		Int64("tq_seq_id", evt.TQSeqID).
+		Logger()
+	portal, err := m.Main.Bridge.GetExistingPortalByKey(ctx, m.makeFBPortalKey(evt.ThreadKey, table.COMMUNITY_GROUP))
+	if err != nil {
+		log.Err(err).Msg("Failed to get portal to check sequence ID")
+		return
+	} else if portal == nil || portal.MXID == "" {
+		return
+	}
+	meta := portal.Metadata.(*metaid.PortalMetadata)
+	prevSeqID := meta.TQSeqID
+	if evt.TQSeqID <= prevSeqID {
+		return
+	}
+	meta.TQSeqID = evt.TQSeqID
+	err = portal.Save(ctx)
+	if err != nil {
+		log.Err(err).Msg("Failed to save sequence ID of thread")
+	}
+	if prevSeqID != 0 && evt.TQSeqID > prevSeqID+1 {
+		log.Debug().Int64("prev_tq_seq_id", prevSeqID).Msg("Found gap in community thread sequence IDs")
+		m.detectCommunityThreadHole(ctx, evt, prevSeqID)
+	}
+}
+
+// detectCommunityThreadHole asks Meta to resend the deltas between the given sequence IDs
+// and handles the response like any other incoming table, which backfills the missed messages.
+func (m *MetaClient) detectCommunityThreadHole(ctx context.Context, evt *table.LSUpdateThreadTQSeqID, prevSeqID int64) {
+	if _, alreadyPending := m.pendingHoleDetections.LoadOrStore(evt.ThreadKey, struct{}{}); alreadyPending {
+		return
+	}
+	go func() {
+		defer m.pendingHoleDetections.Delete(evt.ThreadKey)
+		log := zerolog.Ctx(ctx).With().
+			Str("action", "community thread hole detection").
+			Int64("thread_id", evt.ThreadKey).
+			Logger()
+		resp, err := m.Client.ExecuteTasks(&socket.CommunityThreadHoleDetection{
+			ThreadID:        evt.ThreadKey,
+			PreviousTQSeqID: prevSeqID,
+			CurrentTQSeqID:  evt.TQSeqID,
+			DeltaType:       evt.DeltaType,
+		})
+		if err != nil {
+			log.Err(err).Msg("Failed to run hole detection")
+			return
+		}
+		log.Trace().Any("response", resp).Msg("Hole detection response")
+		select {
+		case m.incomingTables <- resp:
+		case <-ctx.Done():
+		}
+	}()
+}
+
+// ensureCommunitySpace marks the parent portal of a community chat as a space,
+// so that it can be created with the correct room type even if its own thread info hasn't been received yet.
+func (m *MetaClient) ensureCommunitySpace(ctx context.Context, threadKey int64) {
+	portal, err := m.Main.Bridge.GetPortalByKey(ctx, m.makeFBPortalKey(threadKey, table.COMMUNITY_FOLDER))
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Int64("thread_key", threadKey).Msg("Failed to get community space portal")
+		return
+	}
+	meta := portal.Metadata.(*metaid.PortalMetadata)
+	if meta.ThreadType != table.UNKNOWN_THREAD_TYPE || portal.MXID != "" {
+		return
+	}
+	meta.ThreadType = table.COMMUNITY_FOLDER
+	portal.RoomType = database.RoomTypeSpace
+	err = portal.Save(ctx)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Int64("thread_key", threadKey).Msg("Failed to save community space portal")
+	}
+}
+
+func (m *MetaClient) handleInsertCommunityMember(tk handlerParams, evt *table.LSInsertCommunityMember) bridgev2.RemoteEvent {
+	return m.wrapChatInfoChange(evt.CommunityID, evt.ContactID, table.COMMUNITY_FOLDER, &bridgev2.ChatInfoChange{
+		MemberChanges: &bridgev2.ChatMemberList{
+			MemberMap: map[networkid.UserID]bridgev2.ChatMember{
+				metaid.MakeUserID(evt.ContactID): m.wrapCommunityMember(
+					evt.ContactID, evt.Name, evt.ProfilePictureURL, evt.Nickname, evt.IsAdmin, evt.IsModerator,
+				),
+			},
+		},
+	})
+}
+
+func (m *MetaClient) handleUpdateOrInsertCommunityMember(tk handlerParams, evt *table.LSUpdateOrInsertCommunityMember) bridgev2.RemoteEvent {
+	member := m.wrapCommunityMember(evt.ContactID, evt.Name, evt.ProfilePictureURL, evt.Nickname, evt.IsAdmin, evt.IsModerator)
+	if !evt.IsCommunityMember {
+		member.Membership = event.MembershipLeave
+		member.PowerLevel = nil
+	}
+	return m.wrapChatInfoChange(evt.CommunityID, evt.ContactID, table.COMMUNITY_FOLDER, &bridgev2.ChatInfoChange{
+		MemberChanges: &bridgev2.ChatMemberList{
+			MemberMap: map[networkid.UserID]bridgev2.ChatMember{
+				metaid.MakeUserID(evt.ContactID): member,
+			},
+		},
+	})
+}
+
+// getCommunityID finds the community that a community chat belongs to by following the space parents.
+func getCommunityID(portal *bridgev2.Portal) int64 {
+	for parent := portal.Parent; parent != nil; parent = parent.Parent {
+		if parent.Metadata.(*metaid.PortalMetadata).ThreadType == table.COMMUNITY_FOLDER {
+			return metaid.ParseFBPortalID(parent.ID)
+		}
+	}
+	return 0
+}
+
+// createCommunitySubThread creates a new sub-thread in a community chat with the given message as the root.
+func (m *MetaClient) createCommunitySubThread(ctx context.Context, portal *bridgev2.Portal, root *database.Message) (int64, error) {
+	rootID, ok := metaid.ParseMessageID(root.ID).(metaid.ParsedFBMessageID)
+	if !ok {
+		return 0, fmt.Errorf("thread root is not a Messenger message")
+	}
+	communityID := getCommunityID(portal)
+	if communityID == 0 {
+		return 0, fmt.Errorf("community of chat is not known")
+	}
+	threadID := metaid.ParseFBPortalID(portal.ID)
+	resp, err := m.Client.ExecuteTasks(&socket.CreateCommunitySubThread{
+		ClientMutationID: methods.GenerateEpochId(),
+		CommunityID:      communityID,
+		ParentMessageID:  rootID.ID,
+		ParentThreadID:   threadID,
+	})
+	if err != nil {
+		return 0, err
+	}
+	zerolog.Ctx(ctx).Trace().Any("response", resp).Msg("Create community sub-thread response")
+	var subthreadKey int64
+	for _, thread := range resp.LSDeleteThenInsertThread {
+		if thread.ThreadType == table.COMMUNITY_SUB_THREAD && thread.ParentThreadKey == threadID {
+			subthreadKey = thread.ThreadKey
+		}
+	}
+	if subthreadKey == 0 {
+		upsert, insert := resp.WrapMessages()
+		for _, msg := range insert {
+			if msg.MessageId == rootID.ID && msg.SubthreadKey != 0 {
+				subthreadKey = msg.SubthreadKey
+			}
+		}
+		for _, msgs := range upsert {
+			for _, msg := range msgs.Messages {
+				if msg.MessageId == rootID.ID && msg.SubthreadKey != 0 {
+					subthreadKey = msg.SubthreadKey
+				}
+			}
+		}
+	}
+	if subthreadKey == 0 {
+		return 0, fmt.Errorf("sub-thread key not found in response")
+	}
+	err = m.Main.DB.PutThread(ctx, threadID, subthreadKey, rootID.ID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to save sub-thread: %w", err)
+	}
+	return subthreadKey, nil
+}
+
+// ensureCommunitySubThread creates a sub-thread for the given root message if one doesn't exist yet.
+func (m *MetaClient) ensureCommunitySubThread(ctx context.Context, portal *bridgev2.Portal, root *database.Message) error {
+	rootID, ok := metaid.ParseMessageID(root.ID).(metaid.ParsedFBMessageID)
+	if !ok {
+		return fmt.Errorf("thread root is not a Messenger message")
+	}
+	subthreadKey, err := m.Main.DB.GetThreadByMessage(ctx, rootID.ID)
+	if err != nil {
+		return fmt.Errorf("failed to get sub-thread: %w", err)
+	} else if subthreadKey != 0 {
+		return nil
+	}
+	subthreadKey, err = m.createCommunitySubThread(ctx, portal, root)
+	if err != nil {
+		return err
+	}
+	zerolog.Ctx(ctx).Debug().
+		Str("thread_root_id", rootID.ID).
+		Int64("subthread_key", subthreadKey).
+		Msg("Created community sub-thread")
+	return nil
+}
+
+// deleteCommunitySubThread deletes the sub-thread started from the given message.
+func (m *MetaClient) deleteCommunitySubThread(ctx context.Context, root *database.Message) error {
+	root, err := m.resolveTargetMessage(root)
+	if err != nil {
+		return err
+	}
+	rootID, ok := metaid.ParseMessageID(root.ID).(metaid.ParsedFBMessageID)
+	if !ok {
+		return fmt.Errorf("thread root is not a Messenger message")
+	}
+	subthreadKey, err := m.Main.DB.GetThreadByMessage(ctx, rootID.ID)
+	if err != nil {
+		return fmt.Errorf("failed to get sub-thread: %w", err)
+	} else if subthreadKey == 0 {
+		return fmt.Errorf("message doesn't have a thread")
+	}
+	resp, err := m.Client.ExecuteTasks(&socket.DeleteCommunitySubThread{
+		ThreadKey: subthreadKey,
+		ActorID:   metaid.ParseUserLoginID(m.UserLogin.ID),
+		SyncGroup: 104,
+	})
+	if err != nil {
+		return err
+	}
+	zerolog.Ctx(ctx).Trace().Any("response", resp).Msg("Delete community sub-thread response")
+	err = m.Main.DB.DeleteThread(ctx, subthreadKey)
+	if err != nil {
+		return fmt.Errorf("failed to delete sub-thread from database: %w", err)
+	}
+	return nil
+}
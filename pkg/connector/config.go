@@ -10,6 +10,7 @@ import (
 	"gopkg.in/yaml.v3"
 
 	"go.mau.fi/mautrix-meta/pkg/messagix/types"
+	"go.mau.fi/mautrix-meta/pkg/msgconv"
 )
 
 //go:embed example-config.yaml
@@ -26,6 +27,18 @@ type Config struct {
 	DisableXMABackfill bool `yaml:"disable_xma_backfill"`
 	DisableXMAAlways   bool `yaml:"disable_xma_always"`
 
+	DeleteForMeFallback bool `yaml:"delete_for_me_fallback"`
+
+	MarketplaceTag string          `yaml:"marketplace_tag"`
+	AIBotThreads   AIBotThreadMode `yaml:"ai_bot_threads"`
+
+	ViewOnceMedia msgconv.ViewOnceMode `yaml:"view_once_media"`
+
+	XMACacheTTLSeconds int `yaml:"xma_cache_ttl_seconds"`
+
+	PushWakeup            bool `yaml:"push_wakeup"`
+	PushWakeupIdleSeconds int  `yaml:"push_wakeup_idle_seconds"`
+
 	MinFullReconnectIntervalSeconds int `yaml:"min_full_reconnect_interval_seconds"`
 	ForceRefreshIntervalSeconds     int `yaml:"force_refresh_interval_seconds"`
 
@@ -60,6 +73,13 @@ func upgradeConfig(helper up.Helper) {
 	helper.Copy(up.Int, "force_refresh_interval_seconds")
 	helper.Copy(up.Bool, "disable_xma_backfill")
 	helper.Copy(up.Bool, "disable_xma_always")
+	helper.Copy(up.Bool, "delete_for_me_fallback")
+	helper.Copy(up.Str|up.Null, "marketplace_tag")
+	helper.Copy(up.Str, "ai_bot_threads")
+	helper.Copy(up.Str, "view_once_media")
+	helper.Copy(up.Int, "xma_cache_ttl_seconds")
+	helper.Copy(up.Bool, "push_wakeup")
+	helper.Copy(up.Int, "push_wakeup_idle_seconds")
 }
 
 func (m *MetaConnector) GetConfig() (string, any, up.Upgrader) {
@@ -70,6 +90,15 @@ func (m *MetaConnector) ValidateConfig() error {
 	if m.Config.Mode == types.Unset && m.Config.RawMode != "" {
 		return fmt.Errorf("invalid mode %q", m.Config.RawMode)
 	}
+	if !m.Config.AIBotThreads.IsValid() {
+		return fmt.Errorf("invalid ai_bot_threads %q", m.Config.AIBotThreads)
+	}
+	if !m.Config.ViewOnceMedia.IsValid() {
+		return fmt.Errorf("invalid view_once_media %q", m.Config.ViewOnceMedia)
+	}
+	if m.Config.PushWakeup && m.Config.PushWakeupIdleSeconds <= 0 {
+		return fmt.Errorf("push_wakeup_idle_seconds must be positive when push_wakeup is enabled")
+	}
 	return nil
 }
 
@@ -2,6 +2,8 @@ package connector
 
 import (
 	"context"
+	"sync/atomic"
+	"time"
 
 	"go.mau.fi/whatsmeow/store/sqlstore"
 	waLog "go.mau.fi/whatsmeow/util/log"
@@ -19,6 +21,8 @@ type MetaConnector struct {
 	MsgConv     *msgconv.MessageConverter
 	DeviceStore *sqlstore.Container
 	DB          *metadb.MetaDB
+
+	lastEditHistoryCleanup atomic.Int64
 }
 
 var (
@@ -33,9 +37,11 @@ func (m *MetaConnector) Init(bridge *bridgev2.Bridge) {
 		m.Bridge.DB.Dialect.String(),
 		waLog.Zerolog(m.Bridge.Log.With().Str("db_section", "whatsmeow").Logger()),
 	)
-	m.Bridge.Commands.(*commands.Processor).AddHandlers(cmdToggleEncryption)
+	m.Bridge.Commands.(*commands.Processor).AddHandlers(cmdToggleEncryption, cmdSetDisappearingTimer, cmdDeleteThread)
 	m.DB = metadb.New(bridge.DB.Database, m.Bridge.Log.With().Str("db_section", "meta").Logger())
 	m.MsgConv = msgconv.New(bridge, m.DB)
+	m.MsgConv.ViewOnceMode = m.Config.ViewOnceMedia
+	m.MsgConv.XMACacheTTL = time.Duration(m.Config.XMACacheTTLSeconds) * time.Second
 }
 
 func (m *MetaConnector) Start(ctx context.Context) error {
@@ -47,6 +53,13 @@ func (m *MetaConnector) Start(ctx context.Context) error {
 	if err != nil {
 		return bridgev2.DBUpgradeError{Err: err, Section: "meta"}
 	}
+	m.cleanupEditHistory(ctx)
+	if m.Config.PushWakeup {
+		err = m.registerPushHandler()
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -55,7 +68,7 @@ func (m *MetaConnector) SetMaxFileSize(maxSize int64) {
 }
 
 var metaGeneralCaps = &bridgev2.NetworkGeneralCapabilities{
-	DisappearingMessages: false,
+	DisappearingMessages: true,
 	AggressiveUpdateInfo: false,
 }
 
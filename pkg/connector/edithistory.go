@@ -0,0 +1,159 @@
+package connector
+
+import (
+	"context"
+	"time"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/bridgev2/simplevent"
+
+	"go.mau.fi/mautrix-meta/pkg/messagix/socket"
+	"go.mau.fi/mautrix-meta/pkg/messagix/table"
+	"go.mau.fi/mautrix-meta/pkg/metadb"
+	"go.mau.fi/mautrix-meta/pkg/metaid"
+	"go.mau.fi/mautrix-meta/pkg/msgconv"
+)
+
+const (
+	// editHistoryExpiry is how long edit history is kept for messages that haven't been backfilled.
+	editHistoryExpiry = 24 * time.Hour
+	// editHistoryCleanupInterval is how often expired edit history entries are deleted.
+	editHistoryCleanupInterval = 1 * time.Hour
+)
+
+type pendingEditChain struct {
+	MessageID string
+	Sender    bridgev2.EventSender
+	PortalKey networkid.PortalKey
+	Versions  []*metadb.EditHistoryEntry
+}
+
+func (m *MetaClient) storeEditHistory(ctx context.Context, history *table.LSUpdateOrInsertEditMessageHistory) {
+	log := zerolog.Ctx(ctx).With().
+		Str("message_id", history.OriginalMessageID).
+		Int64("edit_ts", history.ServerAdjustedEditTimestampMS).
+		Logger()
+	// History is only useful for messages that haven't been bridged yet,
+	// already bridged messages get edits through LSEditMessage.
+	existing, err := m.Main.Bridge.DB.Message.GetFirstPartByID(ctx, m.UserLogin.ID, metaid.MakeFBMessageID(history.OriginalMessageID))
+	if err != nil {
+		log.Err(err).Msg("Failed to check if edit history target is bridged")
+		return
+	} else if existing != nil {
+		return
+	}
+	err = m.Main.DB.PutEditHistory(ctx, &metadb.EditHistoryEntry{
+		MessageID:     history.OriginalMessageID,
+		EditTimestamp: history.ServerAdjustedEditTimestampMS,
+		Text:          history.MessageContent,
+	})
+	if err != nil {
+		log.Err(err).Msg("Failed to store edit history entry")
+	}
+	m.Main.cleanupEditHistory(ctx)
+}
+
+// cleanupEditHistory deletes edit history of messages that were never backfilled.
+// It's called when new history is stored, but only actually runs once per cleanup interval.
+func (m *MetaConnector) cleanupEditHistory(ctx context.Context) {
+	lastCleanup := m.lastEditHistoryCleanup.Load()
+	now := time.Now()
+	if now.Sub(time.UnixMilli(lastCleanup)) < editHistoryCleanupInterval ||
+		!m.lastEditHistoryCleanup.CompareAndSwap(lastCleanup, now.UnixMilli()) {
+		return
+	}
+	err := m.DB.DeleteExpiredEditHistory(ctx, now.Add(-editHistoryExpiry))
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Msg("Failed to delete expired edit history")
+	}
+}
+
+// discardEditHistory deletes the stored edit history of a message that's bridged without its edit chain.
+func (m *MetaClient) discardEditHistory(ctx context.Context, messageID string) {
+	err := m.Main.DB.DeleteEditHistory(ctx, messageID)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Msg("Failed to delete edit history")
+	}
+}
+
+// rewindEditHistory replaces the text of an edited message with its original version
+// and returns the later versions, which should be bridged as edits after the message itself.
+func (m *MetaClient) rewindEditHistory(ctx context.Context, portal *bridgev2.Portal, msg *table.WrappedMessage, sender bridgev2.EventSender) *pendingEditChain {
+	log := zerolog.Ctx(ctx)
+	versions, err := m.Main.DB.GetEditHistory(ctx, msg.MessageId)
+	if err != nil {
+		log.Err(err).Msg("Failed to get edit history")
+		return nil
+	} else if len(versions) == 0 {
+		return nil
+	}
+	// The history is consumed here, the remaining versions are kept in memory until they're queued
+	m.discardEditHistory(ctx, msg.MessageId)
+	if last := versions[len(versions)-1]; last.Text != msg.Text {
+		versions = append(versions, &metadb.EditHistoryEntry{
+			MessageID:     msg.MessageId,
+			EditTimestamp: max(last.EditTimestamp+1, msg.TimestampMs),
+			Text:          msg.Text,
+		})
+	}
+	if len(versions) < 2 {
+		return nil
+	}
+	mentions := msgconv.RelocateMentionData(ctx, msg.Text, &socket.MentionData{
+		MentionIDs:     msg.MentionIds,
+		MentionOffsets: msg.MentionOffsets,
+		MentionLengths: msg.MentionLengths,
+		MentionTypes:   msg.MentionTypes,
+	}, versions[0].Text)
+	msg.Text = versions[0].Text
+	if mentions != nil {
+		msg.MentionIds = mentions.MentionIDs
+		msg.MentionOffsets = mentions.MentionOffsets
+		msg.MentionLengths = mentions.MentionLengths
+		msg.MentionTypes = mentions.MentionTypes
+	} else {
+		msg.MentionIds, msg.MentionOffsets, msg.MentionLengths, msg.MentionTypes = "", "", "", ""
+	}
+	log.Debug().Int("version_count", len(versions)).Msg("Rewound edited message to original version")
+	return &pendingEditChain{
+		MessageID: msg.MessageId,
+		Sender:    sender,
+		PortalKey: portal.PortalKey,
+		Versions:  versions[1:],
+	}
+}
+
+// queueEditChains queues the later versions of backfilled messages as m.replace events.
+// Backfill batches can't contain edits, so this has to happen separately. Forward backfills are
+// run inside the portal event loop, so the queued edits are only handled after the batch is sent.
+//
+// Edit chains are only reconstructed in forward backfill: backward backfill batches are sent outside
+// the portal event loop, so queued edits could be handled before their target messages exist.
+// Messages bridged by backward backfill only have their latest text.
+func (m *MetaClient) queueEditChains(chains []*pendingEditChain) {
+	for _, chain := range chains {
+		msgID := metaid.MakeFBMessageID(chain.MessageID)
+		for _, version := range chain.Versions {
+			m.Main.Bridge.QueueRemoteEvent(m.UserLogin, &simplevent.Message[string]{
+				EventMeta: simplevent.EventMeta{
+					Type: bridgev2.RemoteEventEdit,
+					LogContext: func(c zerolog.Context) zerolog.Context {
+						return c.Str("message_id", chain.MessageID).Int64("edit_ts", version.EditTimestamp)
+					},
+					PortalKey: chain.PortalKey,
+					Sender:    chain.Sender,
+					Timestamp: time.UnixMilli(version.EditTimestamp),
+				},
+				Data:          version.Text,
+				ID:            msgID,
+				TargetMessage: msgID,
+				ConvertEditFunc: func(ctx context.Context, portal *bridgev2.Portal, intent bridgev2.MatrixAPI, existing []*database.Message, text string) (*bridgev2.ConvertedEdit, error) {
+					return m.convertTextEdit(ctx, portal, existing, text), nil
+				},
+			})
+		}
+	}
+}
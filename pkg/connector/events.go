@@ -12,6 +12,7 @@ import (
 	"go.mau.fi/whatsmeow/proto/waConsumerApplication"
 	"go.mau.fi/whatsmeow/types"
 	"go.mau.fi/whatsmeow/types/events"
+	"golang.org/x/exp/maps"
 	"maunium.net/go/mautrix/bridgev2"
 	"maunium.net/go/mautrix/bridgev2/database"
 	"maunium.net/go/mautrix/bridgev2/networkid"
@@ -63,7 +64,7 @@ func (evt *VerifyThreadExistsEvent) GetType() bridgev2.RemoteEventType {
 }
 
 func (evt *VerifyThreadExistsEvent) ShouldCreatePortal() bool {
-	return evt.FolderName != folderPending && evt.FolderName != folderSpam
+	return evt.FolderName != folderPending && evt.FolderName != folderSpam && evt.m.shouldCreateAIBotPortal(evt.ThreadType)
 }
 
 func (evt *VerifyThreadExistsEvent) GetPortalKey() networkid.PortalKey {
@@ -118,9 +119,15 @@ var (
 	_ bridgev2.RemoteMessage                          = (*FBMessageEvent)(nil)
 	_ bridgev2.RemoteEventWithUncertainPortalReceiver = (*FBMessageEvent)(nil)
 	_ bridgev2.RemoteEventWithTimestamp               = (*FBMessageEvent)(nil)
+	_ bridgev2.RemoteMessageUpsert                    = (*FBMessageEvent)(nil)
+	_ bridgev2.RemoteMessageWithTransactionID         = (*FBMessageEvent)(nil)
 )
 
 func (evt *FBMessageEvent) GetType() bridgev2.RemoteEventType {
+	if evt.m.getPendingEcho(evt.OfflineThreadingId) != nil {
+		// Echoes of messages sent from Matrix are handled as upserts to patch the ID and timestamp
+		return bridgev2.RemoteEventMessageUpsert
+	}
 	return bridgev2.RemoteEventMessage
 }
 
@@ -141,9 +148,16 @@ func (evt *FBMessageEvent) GetSender() bridgev2.EventSender {
 }
 
 func (evt *FBMessageEvent) GetID() networkid.MessageID {
+	if echo := evt.m.getPendingEcho(evt.OfflineThreadingId); echo != nil && echo.MessageID != "" {
+		return echo.MessageID
+	}
 	return metaid.MakeFBMessageID(evt.MessageId)
 }
 
+func (evt *FBMessageEvent) GetTransactionID() networkid.TransactionID {
+	return networkid.TransactionID(evt.OfflineThreadingId)
+}
+
 func (evt *FBMessageEvent) GetTimestamp() time.Time {
 	return time.UnixMilli(evt.TimestampMs)
 }
@@ -187,17 +201,29 @@ func (evt *FBEditEvent) GetTargetMessage() networkid.MessageID {
 }
 
 func (evt *FBEditEvent) ConvertEdit(ctx context.Context, portal *bridgev2.Portal, intent bridgev2.MatrixAPI, existing []*database.Message) (*bridgev2.ConvertedEdit, error) {
-	textPart := existing[0] // TODO: Figure out a better way to get the text part, esp. if there are attachments etc.
+	return evt.m.convertTextEdit(ctx, portal, existing, evt.Text), nil
+}
+
+func (m *MetaClient) convertTextEdit(ctx context.Context, portal *bridgev2.Portal, existing []*database.Message, text string) *bridgev2.ConvertedEdit {
+	// The text part is always the last one. Messages bridged before text parts were marked don't have
+	// the flag, but the last part is still the best guess for them.
+	textPart := existing[len(existing)-1]
+	for _, part := range existing {
+		if part.Metadata.(*metaid.MessageMetadata).IsTextPart {
+			textPart = part
+			break
+		}
+	}
 
 	return &bridgev2.ConvertedEdit{
 		ModifiedParts: []*bridgev2.ConvertedEditPart{
 			{
 				Part:    textPart,
 				Type:    event.EventMessage,
-				Content: evt.m.Main.MsgConv.MetaToMatrixText(ctx, evt.Text, nil, portal),
+				Content: m.Main.MsgConv.MetaEditToMatrixText(ctx, text, textPart.Metadata.(*metaid.MessageMetadata), portal),
 			},
 		},
-	}, nil
+	}
 }
 
 type EnsureWAChatStateEvent struct {
@@ -435,6 +461,13 @@ func (evt *WAMessageEvent) GetTimestamp() time.Time {
 }
 
 func (evt *WAMessageEvent) ConvertMessage(ctx context.Context, portal *bridgev2.Portal, intent bridgev2.MatrixAPI) (*bridgev2.ConvertedMessage, error) {
+	if setting := evt.Application.GetMetadata().GetChatEphemeralSetting(); setting != nil {
+		meta := portal.Metadata.(*metaid.PortalMetadata)
+		if setting.GetEphemeralSettingTimestamp() > meta.EphemeralSettingTS {
+			meta.EphemeralSettingTS = setting.GetEphemeralSettingTimestamp()
+			portal.UpdateDisappearingSetting(ctx, wrapWAEphemeralSetting(setting), intent, evt.Info.Timestamp, false, true)
+		}
+	}
 	return evt.m.Main.MsgConv.WhatsAppToMatrix(ctx, portal, evt.m.E2EEClient, intent, evt.FBMessage), nil
 }
 
@@ -484,7 +517,7 @@ func (r *FBChatResync) ShouldCreatePortal() bool {
 	if r.Raw == nil {
 		return false
 	}
-	return r.Raw.FolderName != folderPending && r.Raw.FolderName != folderSpam
+	return r.Raw.FolderName != folderPending && r.Raw.FolderName != folderSpam && r.m.shouldCreateAIBotPortal(r.Raw.ThreadType)
 }
 
 func (r *FBChatResync) AddLogContext(c zerolog.Context) zerolog.Context {
@@ -514,9 +547,15 @@ func (r *FBChatResync) GetChatInfo(ctx context.Context, portal *bridgev2.Portal)
 	}
 	if len(r.Members) > 0 && !r.filled {
 		self := r.Info.Members.MemberMap[networkid.UserID(r.m.UserLogin.ID)]
+		prevMembers := r.Info.Members.MemberMap
 		r.Info.Members.MemberMap = make(map[networkid.UserID]bridgev2.ChatMember, len(r.Members))
 		for id, member := range r.Members {
-			r.Info.Members.MemberMap[metaid.MakeUserID(id)] = member
+			userID := metaid.MakeUserID(id)
+			if member.UserInfo == nil {
+				// Keep user info derived from the thread itself (e.g. AI bot names)
+				member.UserInfo = prevMembers[userID].UserInfo
+			}
+			r.Info.Members.MemberMap[userID] = member
 		}
 		if r.Info.Members.TotalMemberCount > 0 {
 			r.Info.Members.IsFull = len(r.Members) == r.Info.Members.TotalMemberCount
@@ -532,6 +571,7 @@ func (r *FBChatResync) GetChatInfo(ctx context.Context, portal *bridgev2.Portal)
 			r.Info.Members.MemberMap[self.Sender] = self
 		}
 		r.filled = true
+		r.Info.ExtraUpdates = bridgev2.MergeExtraUpdaters(r.Info.ExtraUpdates, r.m.nicknameUpdater(maps.Values(r.Members)))
 		if len(r.Info.Members.MemberMap) == 1 && portal.OtherUserID != "" && portal.OtherUserID == networkid.UserID(portal.Receiver) {
 			r.Info.Members.MemberMap = makeNoteToSelfMembers(portal.OtherUserID, r.Info.Members.MemberMap[portal.OtherUserID].UserInfo)
 		}
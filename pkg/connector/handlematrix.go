@@ -16,6 +16,7 @@ import (
 	"maunium.net/go/mautrix/bridgev2"
 	"maunium.net/go/mautrix/bridgev2/database"
 	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/event"
 
 	"go.mau.fi/mautrix-meta/pkg/messagix"
 	"go.mau.fi/mautrix-meta/pkg/messagix/socket"
@@ -29,11 +30,13 @@ var (
 	_ bridgev2.ReactionHandlingNetworkAPI    = (*MetaClient)(nil)
 	_ bridgev2.RedactionHandlingNetworkAPI   = (*MetaClient)(nil)
 	_ bridgev2.ReadReceiptHandlingNetworkAPI = (*MetaClient)(nil)
+	_ bridgev2.TypingHandlingNetworkAPI      = (*MetaClient)(nil)
 )
 
 var (
 	ErrServerRejectedMessage = bridgev2.WrapErrorInStatus(errors.New("server rejected message")).WithErrorAsMessage().WithSendNotice(true)
 	ErrNotConnected          = bridgev2.WrapErrorInStatus(errors.New("not connected")).WithErrorAsMessage().WithSendNotice(true)
+	ErrCantUnsend            = bridgev2.WrapErrorInStatus(errors.New("message can't be unsent")).WithErrorAsMessage().WithSendNotice(true)
 )
 
 const ConnectWaitTimeout = 1 * time.Minute
@@ -42,7 +45,7 @@ func (m *MetaClient) HandleMatrixMessage(ctx context.Context, msg *bridgev2.Matr
 	if m.LoginMeta.Cookies == nil {
 		return nil, bridgev2.ErrNotLoggedIn
 	}
-	log := zerolog.Ctx(ctx)
+	m.markActive()
 
 	portalMeta := msg.Portal.Metadata.(*metaid.PortalMetadata)
 
@@ -73,11 +76,28 @@ func (m *MetaClient) HandleMatrixMessage(ctx context.Context, msg *bridgev2.Matr
 			},
 		}, nil
 	default:
-		if !m.connectWaiter.WaitTimeout(ConnectWaitTimeout) {
+		replyTo, err := m.resolveTargetMessage(msg.ReplyTo)
+		if err != nil {
+			return nil, err
+		}
+		threadRoot, err := m.resolveTargetMessage(msg.ThreadRoot)
+		if err != nil {
+			return nil, err
+		}
+		if portalMeta.ThreadType == table.COMMUNITY_GROUP && threadRoot != nil {
+			if !m.connectWaiter.WaitTimeout(ConnectWaitTimeout) {
+				return nil, ErrNotConnected
+			}
+			err := m.ensureCommunitySubThread(ctx, msg.Portal, threadRoot)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create thread: %w", err)
+			}
+		} else if (msg.Content.MsgType.IsMedia() || msg.Event.Type == event.EventSticker) && !m.connectWaiter.WaitTimeout(ConnectWaitTimeout) {
+			// Media has to be uploaded before the message can be queued
 			return nil, ErrNotConnected
 		}
 
-		tasks, otid, err := m.Main.MsgConv.ToMeta(ctx, m.Client, msg.Event, msg.Content, msg.ReplyTo, msg.ThreadRoot, msg.OrigSender != nil, msg.Portal)
+		tasks, otid, err := m.Main.MsgConv.ToMeta(ctx, m.Client, msg.Event, msg.Content, replyTo, threadRoot, msg.OrigSender != nil, msg.Portal)
 		if errors.Is(err, types.ErrPleaseReloadPage) {
 			// TODO handle properly
 			return nil, err
@@ -88,72 +108,152 @@ func (m *MetaClient) HandleMatrixMessage(ctx context.Context, msg *bridgev2.Matr
 			return nil, fmt.Errorf("failed to convert message: %w", err)
 		}
 
-		log.UpdateContext(func(c zerolog.Context) zerolog.Context {
-			return c.Int64("otid", otid)
-		})
-		log.Debug().Msg("Sending Matrix message to Meta")
+		return m.sendMetaMessage(ctx, msg, tasks, otid)
+	}
+}
 
-		otidStr := strconv.FormatInt(otid, 10)
+// sendMetaMessage queues and sends the tasks of a converted Matrix message to Meta.
+func (m *MetaClient) sendMetaMessage(ctx context.Context, msg *bridgev2.MatrixMessage, tasks []socket.Task, otid int64) (*bridgev2.MatrixMessageResponse, error) {
+	log := zerolog.Ctx(ctx).With().Int64("otid", otid).Logger()
+	ctx = log.WithContext(ctx)
+	log.Debug().Msg("Sending Matrix message to Meta")
 
-		var resp *table.LSTable
+	otidStr := strconv.FormatInt(otid, 10)
+	txnID := networkid.TransactionID(otidStr)
 
-		retries := 0
-		for retries < 5 {
-			if err = m.Client.WaitUntilCanSendMessages(15 * time.Second); err != nil {
-				log.Err(err).Msg("Error waiting to be able to send messages, retrying")
-			} else {
-				resp, err = m.Client.ExecuteTasks(tasks...)
-				if err == nil {
-					break
-				}
-				log.Err(err).Msg("Failed to send message to Meta, retrying")
-			}
-			retries++
-		}
+	m.markOutgoingInFlight(otid)
+	defer m.unmarkOutgoingInFlight(otid)
+	err := m.enqueueOutgoing(ctx, msg, otid, tasks)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save message to send queue: %w", err)
+	}
 
-		log.Trace().Any("response", resp).Msg("Meta send response")
-		var msgID string
-		if resp != nil && err == nil {
-			for _, replace := range resp.LSReplaceOptimsiticMessage {
-				if replace.OfflineThreadingId == otidStr {
-					msgID = replace.MessageId
-				}
-			}
-			if len(msgID) == 0 {
-				for _, failed := range resp.LSMarkOptimisticMessageFailed {
-					if failed.OTID == otidStr {
-						log.Warn().Str("message", failed.Message).Msg("Sending message failed (optimistic)")
-						return nil, fmt.Errorf("%w: %s", ErrServerRejectedMessage, failed.Message)
-					}
-				}
-				for _, failed := range resp.LSHandleFailedTask {
-					if failed.OTID == otidStr {
-						log.Warn().Str("message", failed.Message).Msg("Sending message failed (task)")
-						return nil, fmt.Errorf("%w: %s", ErrServerRejectedMessage, failed.Message)
-					}
-				}
-				log.Warn().Msg("Message send response didn't include message ID")
+	// If the message can't be sent right now, it's saved to the database when the echo arrives
+	m.addPendingEcho(otidStr)
+	msg.AddPendingToSave(&database.Message{SenderID: networkid.UserID(m.UserLogin.ID)}, txnID, nil)
+	if !m.connectWaiter.IsSet() {
+		log.Debug().Msg("Not connected to Meta, leaving message in the send queue")
+		m.sendPendingStatus(ctx, msg.Event)
+		return &bridgev2.MatrixMessageResponse{Pending: true}, nil
+	}
+
+	var resp *table.LSTable
+	retries := 0
+	for retries < 5 {
+		if err = m.Client.WaitUntilCanSendMessages(15 * time.Second); err != nil {
+			log.Err(err).Msg("Error waiting to be able to send messages, retrying")
+		} else {
+			resp, err = m.Client.ExecuteTasks(tasks...)
+			if err == nil {
+				break
 			}
+			log.Err(err).Msg("Failed to send message to Meta, retrying")
 		}
+		retries++
+	}
+	if err != nil {
+		log.Warn().Err(err).Msg("Couldn't send message to Meta, leaving it in the send queue")
+		m.sendPendingStatus(ctx, msg.Event)
+		if m.connectWaiter.IsSet() {
+			// The connection may have come back while this message was in flight, which means the flush skipped it
+			go func() {
+				m.unmarkOutgoingInFlight(otid)
+				m.flushOutgoingQueue(context.WithoutCancel(ctx))
+			}()
+		}
+		return &bridgev2.MatrixMessageResponse{Pending: true}, nil
+	}
+	_, err = m.Main.DB.DeleteOutgoingMessage(ctx, otid)
+	if err != nil {
+		log.Err(err).Msg("Failed to remove sent message from send queue")
+	}
 
-		return &bridgev2.MatrixMessageResponse{
-			DB: &database.Message{
-				ID:       metaid.MakeFBMessageID(msgID),
-				SenderID: networkid.UserID(m.UserLogin.ID),
-			},
-		}, nil
+	log.Trace().Any("response", resp).Msg("Meta send response")
+	// The echo can't be handled before this handler returns, as both happen in the portal event loop,
+	// so the message is saved here with the ID from the response instead.
+	msg.RemovePending(txnID)
+	msgID, ts, err := parseSendResponse(&log, resp, otidStr)
+	if err != nil {
+		m.removePendingEcho(otidStr)
+		return nil, err
 	}
+
+	return &bridgev2.MatrixMessageResponse{
+		DB: &database.Message{
+			ID:        m.setPendingEchoID(otidStr, msgID),
+			SenderID:  networkid.UserID(m.UserLogin.ID),
+			Timestamp: ts,
+		},
+	}, nil
 }
 
 func (m *MetaClient) PreHandleMatrixReaction(ctx context.Context, msg *bridgev2.MatrixReaction) (bridgev2.MatrixReactionPreResponse, error) {
+	emoji := variationselector.Remove(msg.Content.RelatesTo.Key)
+	if msg.Portal.Metadata.(*metaid.PortalMetadata).ThreadType == table.COMMUNITY_GROUP {
+		// Communities allow multiple reactions per user
+		return bridgev2.MatrixReactionPreResponse{
+			SenderID: networkid.UserID(m.UserLogin.ID),
+			EmojiID:  networkid.EmojiID(emoji),
+			Emoji:    emoji,
+		}, nil
+	}
 	return bridgev2.MatrixReactionPreResponse{
 		SenderID:     networkid.UserID(m.UserLogin.ID),
 		EmojiID:      "",
-		Emoji:        variationselector.Remove(msg.Content.RelatesTo.Key),
+		Emoji:        emoji,
 		MaxReactions: 1,
 	}, nil
 }
 
+func (m *MetaClient) sendReactionV2(ctx context.Context, target *database.Message, messageID, emoji string, add bool) error {
+	threadID := metaid.ParseFBPortalID(target.Room.ID)
+	if target.ThreadRoot != "" {
+		parsedRootID, err := m.resolveMessageID(target.ThreadRoot)
+		if err != nil {
+			return err
+		}
+		threadRootID, _ := parsedRootID.(metaid.ParsedFBMessageID)
+		subthreadID, err := m.Main.DB.GetThreadByMessage(ctx, threadRootID.ID)
+		if err != nil {
+			return fmt.Errorf("failed to get subthread of message: %w", err)
+		} else if subthreadID != 0 {
+			threadID = subthreadID
+		}
+	}
+	task := &socket.SendReactionV2Task{
+		ThreadID:         threadID,
+		MessageID:        messageID,
+		MessageTimestamp: target.Timestamp.UnixMilli(),
+		ActorID:          metaid.ParseUserLoginID(m.UserLogin.ID),
+		ReactionStyle:    1,
+		ViewerIsReactor:  1,
+		Operation:        1,
+		ReactionLiteral:  emoji,
+		SyncGroup:        104,
+	}
+	if !add {
+		task.ViewerIsReactor = 0
+		task.Operation = 3
+	}
+	summaries, err := m.Main.DB.GetReactionsV2(ctx, messageID)
+	if err != nil {
+		return fmt.Errorf("failed to get existing reactions: %w", err)
+	}
+	for _, summary := range summaries {
+		if summary.Reaction == emoji {
+			task.ReactionFBID = summary.ReactionFBID
+			task.CurrentCount = int(summary.Count)
+			break
+		}
+	}
+	resp, err := m.Client.ExecuteTasks(task)
+	if err != nil {
+		return err
+	}
+	zerolog.Ctx(ctx).Trace().Any("response", resp).Msg("Meta community reaction response")
+	return nil
+}
+
 func wrapReaction(message *waConsumerApplication.ConsumerApplication_ReactionMessage) *waConsumerApplication.ConsumerApplication {
 	return &waConsumerApplication.ConsumerApplication{
 		Payload: &waConsumerApplication.ConsumerApplication_Payload{
@@ -200,11 +300,23 @@ func (m *MetaClient) HandleMatrixReaction(ctx context.Context, msg *bridgev2.Mat
 	if m.LoginMeta.Cookies == nil {
 		return nil, bridgev2.ErrNotLoggedIn
 	}
-	switch messageID := metaid.ParseMessageID(msg.TargetMessage.ID).(type) {
+	m.markActive()
+	parsedID, err := m.resolveMessageID(msg.TargetMessage.ID)
+	if err != nil {
+		return nil, err
+	}
+	switch messageID := parsedID.(type) {
 	case metaid.ParsedFBMessageID:
 		if !m.connectWaiter.WaitTimeout(ConnectWaitTimeout) {
 			return nil, ErrNotConnected
 		}
+		if msg.Portal.Metadata.(*metaid.PortalMetadata).ThreadType == table.COMMUNITY_GROUP {
+			err := m.sendReactionV2(ctx, msg.TargetMessage, messageID.ID, msg.PreHandleResp.Emoji, true)
+			if err != nil {
+				return nil, err
+			}
+			return &database.Reaction{}, nil
+		}
 		resp, err := m.Client.ExecuteTasks(&socket.SendReactionTask{
 			ThreadKey:       metaid.ParseFBPortalID(msg.Portal.ID),
 			TimestampMs:     msg.Event.Timestamp,
@@ -242,11 +354,25 @@ func (m *MetaClient) HandleMatrixReactionRemove(ctx context.Context, msg *bridge
 	if m.LoginMeta.Cookies == nil {
 		return bridgev2.ErrNotLoggedIn
 	}
-	switch messageID := metaid.ParseMessageID(msg.TargetReaction.MessageID).(type) {
+	m.markActive()
+	parsedID, err := m.resolveMessageID(msg.TargetReaction.MessageID)
+	if err != nil {
+		return err
+	}
+	switch messageID := parsedID.(type) {
 	case metaid.ParsedFBMessageID:
 		if !m.connectWaiter.WaitTimeout(ConnectWaitTimeout) {
 			return ErrNotConnected
 		}
+		if msg.Portal.Metadata.(*metaid.PortalMetadata).ThreadType == table.COMMUNITY_GROUP {
+			target, err := m.Main.Bridge.DB.Message.GetFirstPartByID(ctx, msg.Portal.Receiver, msg.TargetReaction.MessageID)
+			if err != nil {
+				return fmt.Errorf("failed to get reaction target message: %w", err)
+			} else if target == nil {
+				return fmt.Errorf("reaction target message not found")
+			}
+			return m.sendReactionV2(ctx, target, messageID.ID, msg.TargetReaction.Emoji, false)
+		}
 		resp, err := m.Client.ExecuteTasks(&socket.SendReactionTask{
 			ThreadKey:       metaid.ParseFBPortalID(msg.Portal.ID),
 			TimestampMs:     msg.Event.Timestamp,
@@ -283,22 +409,20 @@ func (m *MetaClient) HandleMatrixEdit(ctx context.Context, edit *bridgev2.Matrix
 	if m.LoginMeta.Cookies == nil {
 		return bridgev2.ErrNotLoggedIn
 	}
+	m.markActive()
 	log := zerolog.Ctx(ctx)
-	switch messageID := metaid.ParseMessageID(edit.EditTarget.ID).(type) {
+	parsedID, err := m.resolveMessageID(edit.EditTarget.ID)
+	if err != nil {
+		return err
+	}
+	switch messageID := parsedID.(type) {
 	case metaid.ParsedFBMessageID:
 		if !m.connectWaiter.WaitTimeout(ConnectWaitTimeout) {
 			return ErrNotConnected
 		}
-		fakeSendTasks, _, err := m.Main.MsgConv.ToMeta(ctx, m.Client, edit.Event, edit.Content, nil, nil, false, edit.Portal)
+		editTask, err := m.Main.MsgConv.ToMetaEdit(ctx, messageID.ID, edit.Content, edit.Portal)
 		if err != nil {
-			return fmt.Errorf("failed to convert message: %w", err)
-		}
-
-		fakeTask := fakeSendTasks[0].(*socket.SendMessageTask)
-
-		editTask := &socket.EditMessageTask{
-			MessageID: messageID.ID,
-			Text:      fakeTask.Text,
+			return fmt.Errorf("failed to convert edit: %w", err)
 		}
 
 		newEditCount := int64(edit.EditTarget.EditCount) + 1
@@ -352,13 +476,29 @@ func (m *MetaClient) HandleMatrixMessageRemove(ctx context.Context, msg *bridgev
 	if m.LoginMeta.Cookies == nil {
 		return bridgev2.ErrNotLoggedIn
 	}
+	m.markActive()
 	log := zerolog.Ctx(ctx)
-	switch messageID := metaid.ParseMessageID(msg.TargetMessage.ID).(type) {
+	parsedID, err := m.resolveMessageID(msg.TargetMessage.ID)
+	if err != nil {
+		return err
+	}
+	switch messageID := parsedID.(type) {
 	case metaid.ParsedFBMessageID:
 		if !m.connectWaiter.WaitTimeout(ConnectWaitTimeout) {
 			return ErrNotConnected
 		}
-		resp, err := m.Client.ExecuteTasks(&socket.DeleteMessageTask{MessageId: messageID.ID})
+		var task socket.Task = &socket.DeleteMessageTask{MessageId: messageID.ID}
+		if reason := m.getCannotUnsendReason(msg.Portal, msg.TargetMessage); reason != table.CAN_UNSEND {
+			if !m.Main.Config.DeleteForMeFallback {
+				return fmt.Errorf("%w (reason: %d)", ErrCantUnsend, reason)
+			}
+			log.Debug().Int64("cannot_unsend_reason", int64(reason)).Msg("Message can't be unsent, deleting for self only")
+			task = &socket.DeleteMessageMeOnlyTask{
+				ThreadKey: metaid.ParseFBPortalID(msg.Portal.ID),
+				MessageId: messageID.ID,
+			}
+		}
+		resp, err := m.Client.ExecuteTasks(task)
 		// TODO does the response data need to be checked?
 		log.Trace().Any("response", resp).Msg("Meta delete response")
 		return err
@@ -378,10 +518,22 @@ func (m *MetaClient) HandleMatrixMessageRemove(ctx context.Context, msg *bridgev
 	}
 }
 
+// getCannotUnsendReason checks whether the given message can be unsent for everyone,
+// based on the sender and the unsendability statuses Meta sent for the message and the thread.
+func (m *MetaClient) getCannotUnsendReason(portal *bridgev2.Portal, msg *database.Message) table.MessageUnsendabilityStatus {
+	if msg.SenderID != networkid.UserID(m.UserLogin.ID) {
+		return table.DENY_FOR_NON_SENDER
+	} else if reason := msg.Metadata.(*metaid.MessageMetadata).CannotUnsendReason; reason != table.CAN_UNSEND {
+		return reason
+	}
+	return portal.Metadata.(*metaid.PortalMetadata).CannotUnsendReason
+}
+
 func (m *MetaClient) HandleMatrixReadReceipt(ctx context.Context, receipt *bridgev2.MatrixReadReceipt) error {
 	if m.LoginMeta.Cookies == nil {
 		return bridgev2.ErrNotLoggedIn
 	}
+	m.markActive()
 	if !receipt.ReadUpTo.After(receipt.LastRead) {
 		return nil
 	}
@@ -404,7 +556,8 @@ func (m *MetaClient) HandleMatrixReadReceipt(ctx context.Context, receipt *bridg
 	var fbMessageToReadTS time.Time
 	for _, msg := range messages {
 		switch messageID := metaid.ParseMessageID(msg.ID).(type) {
-		case metaid.ParsedFBMessageID:
+		case metaid.ParsedFBMessageID, metaid.ParsedPendingMessageID:
+			// The read watermark is a timestamp, so messages that are still being sent don't need their real ID
 			if fbMessageToReadTS.Before(msg.Timestamp) {
 				fbMessageToReadTS = msg.Timestamp
 			}
@@ -447,3 +600,23 @@ func (m *MetaClient) HandleMatrixReadReceipt(ctx context.Context, receipt *bridg
 	}
 	return nil
 }
+
+func (m *MetaClient) HandleMatrixTyping(ctx context.Context, msg *bridgev2.MatrixTyping) error {
+	if m.LoginMeta.Cookies == nil {
+		return bridgev2.ErrNotLoggedIn
+	}
+	threadID := metaid.ParseFBPortalID(msg.Portal.ID)
+	if threadID == 0 || msg.Type != bridgev2.TypingTypeText {
+		return nil
+	}
+	m.markActive()
+	if !m.connectWaiter.IsSet() {
+		// Typing notifications aren't worth waiting for the connection
+		return nil
+	}
+	err := m.Client.SetTyping(threadID, msg.Portal.Metadata.(*metaid.PortalMetadata).ThreadType, msg.IsTyping)
+	if err != nil {
+		return fmt.Errorf("failed to send typing notification: %w", err)
+	}
+	return nil
+}
@@ -15,8 +15,10 @@ import (
 	"maunium.net/go/mautrix/event"
 
 	"go.mau.fi/mautrix-meta/pkg/messagix"
+	"go.mau.fi/mautrix-meta/pkg/messagix/socket"
 	"go.mau.fi/mautrix-meta/pkg/messagix/table"
 	"go.mau.fi/mautrix-meta/pkg/messagix/types"
+	"go.mau.fi/mautrix-meta/pkg/metadb"
 	"go.mau.fi/mautrix-meta/pkg/metaid"
 )
 
@@ -61,6 +63,9 @@ func (m *MetaClient) handleMetaEvent(rawEvt any) {
 	switch evt := rawEvt.(type) {
 	case *messagix.Event_PublishResponse:
 		log.Trace().Any("table", &evt.Table).Msg("Got new event")
+		if len(evt.Table.LSInsertMessage) > 0 || len(evt.Table.LSUpsertMessage) > 0 {
+			m.markActive()
+		}
 		select {
 		case m.incomingTables <- evt.Table:
 		default:
@@ -72,6 +77,7 @@ func (m *MetaClient) handleMetaEvent(rawEvt any) {
 	case *messagix.Event_Ready:
 		log.Debug().Msg("Initial connect to Meta socket completed")
 		m.connectWaiter.Set()
+		go m.flushOutgoingQueue(log.WithContext(context.Background()))
 		if tbl := m.initialTable.Swap(nil); tbl != nil {
 			log.Debug().Msg("Sending cached initial table to handler")
 			m.incomingTables <- tbl
@@ -96,6 +102,7 @@ func (m *MetaClient) handleMetaEvent(rawEvt any) {
 	case *messagix.Event_Reconnected:
 		log.Debug().Msg("Reconnected to Meta socket")
 		m.connectWaiter.Set()
+		go m.flushOutgoingQueue(log.WithContext(context.Background()))
 		m.metaState = status.BridgeState{StateEvent: status.StateConnected}
 		m.UserLogin.BridgeState.Send(m.metaState)
 	case *messagix.Event_PermanentError:
@@ -172,6 +179,12 @@ func (m *MetaClient) handleTable(ctx context.Context, tbl *table.LSTable) {
 	for _, contact := range tbl.LSVerifyContactRowExists {
 		m.syncGhost(ctx, contact)
 	}
+	for _, info := range tbl.LSDeleteThenInsertIGContactInfo {
+		m.syncIGContactInfo(ctx, info)
+	}
+	for _, bot := range tbl.LSDeleteThenInsertBotProfileInfoV2 {
+		m.syncBotProfile(ctx, bot)
+	}
 
 	threadExists := make(map[int64]*table.LSVerifyThreadExists, len(tbl.LSVerifyThreadExists))
 	threadResyncs := make(map[int64]*FBChatResync, len(tbl.LSDeleteThenInsertThread))
@@ -184,8 +197,10 @@ func (m *MetaClient) handleTable(ctx context.Context, tbl *table.LSTable) {
 
 	for _, thread := range tbl.LSVerifyThreadExists {
 		threadExists[thread.ThreadKey] = thread
+		m.rememberAIBotThread(thread.ThreadKey, thread.ThreadType)
 	}
 	for _, thread := range tbl.LSDeleteThenInsertThread {
+		m.rememberAIBotThread(thread.ThreadKey, thread.ThreadType)
 		threadResyncs[thread.ThreadKey] = &FBChatResync{
 			PortalKey: m.makeFBPortalKey(thread.ThreadKey, thread.ThreadType),
 			Info:      m.wrapChatInfo(thread),
@@ -193,6 +208,11 @@ func (m *MetaClient) handleTable(ctx context.Context, tbl *table.LSTable) {
 			Members:   make(map[int64]bridgev2.ChatMember, thread.MemberCount),
 			m:         m,
 		}
+		if thread.ThreadType == table.COMMUNITY_FOLDER {
+			m.maybeSyncCommunityMembers(ctx, thread)
+		} else if thread.ParentThreadKey > 0 && thread.ThreadType != table.COMMUNITY_SUB_THREAD {
+			m.ensureCommunitySpace(ctx, thread.ParentThreadKey)
+		}
 	}
 	// TODO resync threads with LSUpdateOrInsertThread?
 
@@ -210,6 +230,12 @@ func (m *MetaClient) handleTable(ctx context.Context, tbl *table.LSTable) {
 	handlePortalEvents(params, tbl.LSAddParticipantIdToGroupThread, m.handleAddParticipant)
 	handlePortalEvents(params, tbl.LSUpdateThreadMuteSetting, m.handleUpdateMuteSetting)
 	handlePortalEvents(params, tbl.LSMoveThreadToE2EECutoverFolder, m.handleMoveThreadToE2EE)
+	// Results for queued messages must be saved before the echoes are handled
+	m.reconcileOutgoing(ctx, tbl)
+	// Edit history must be stored before backfill batches are converted
+	for _, history := range tbl.LSUpdateOrInsertEditMessageHistory {
+		m.storeEditHistory(ctx, history)
+	}
 	upsert, insert := tbl.WrapMessages()
 	handlePortalEvents(params, maps.Values(upsert), m.handleUpsertMessages)
 	handlePortalEvents(params, tbl.LSUpdateExistingMessageRange, m.handleUpdateExistingMessageRange)
@@ -225,6 +251,8 @@ func (m *MetaClient) handleTable(ctx context.Context, tbl *table.LSTable) {
 	}
 	handlePortalEvents(params, tbl.LSSyncUpdateThreadName, m.handleUpdateThreadName)
 	handlePortalEvents(params, tbl.LSSetThreadImageURL, m.handleSetThreadImage)
+	handlePortalEvents(params, tbl.LSUpdateOrInsertThread, m.handleUpdateOrInsertThread)
+	handlePortalEvents(params, tbl.LSSetThreadCannotUnsendReason, m.handleSetThreadCannotUnsendReason)
 	handlePortalEvents(params, tbl.LSUpdateReadReceipt, m.handleUpdateReadReceipt)
 	handlePortalEvents(params, tbl.LSMarkThreadReadV2, m.handleMarkThreadRead)
 	handlePortalEvents(params, tbl.LSUpdateTypingIndicator, m.handleTypingIndicator)
@@ -232,7 +260,15 @@ func (m *MetaClient) handleTable(ctx context.Context, tbl *table.LSTable) {
 	handlePortalEvents(params, tbl.LSDeleteThenInsertMessage, m.handleDeleteThenInsertMessage)
 	handlePortalEvents(params, tbl.LSUpsertReaction, m.handleUpsertReaction)
 	handlePortalEvents(params, tbl.LSDeleteReaction, m.handleDeleteReaction)
+	handlePortalEvents(params, tbl.LSUpdateOrInsertReactionV2, m.handleUpdateOrInsertReactionV2)
+	handlePortalEvents(params, tbl.LSDeleteReactionV2, m.handleDeleteReactionV2)
+	handlePortalEvents(params, tbl.LSDeleteThenInsertReactionsV2Detail, m.handleReactionV2Detail)
 	handlePortalEvents(params, tbl.LSRemoveParticipantFromThread, m.handleRemoveParticipant)
+	handlePortalEvents(params, tbl.LSInsertCommunityMember, m.handleInsertCommunityMember)
+	handlePortalEvents(params, tbl.LSUpdateOrInsertCommunityMember, m.handleUpdateOrInsertCommunityMember)
+	for _, seqID := range tbl.LSUpdateThreadTQSeqID {
+		m.handleThreadTQSeqID(ctx, seqID)
+	}
 	// TODO request more inbox if applicable
 }
 
@@ -314,6 +350,15 @@ func (m *MetaClient) handleDeleteThenInsertMessage(tk handlerParams, msg *table.
 }
 
 func (m *MetaClient) handleDeleteThread(tk handlerParams, msg *table.LSDeleteThread) bridgev2.RemoteEvent {
+	if tk.ThreadMsgID != "" {
+		// Community sub-threads are bridged as Matrix threads inside the parent chat,
+		// so deleting one must not delete the parent portal.
+		err := m.Main.DB.DeleteThread(tk.ctx, msg.ThreadKey)
+		if err != nil {
+			zerolog.Ctx(tk.ctx).Err(err).Int64("subthread_key", msg.ThreadKey).Msg("Failed to delete sub-thread")
+		}
+		return nil
+	}
 	// TODO figure out how to handle meta's false delete events
 	// Delete the thread from the sync maps to prevent future events finding it
 	delete(tk.syncs, msg.ThreadKey)
@@ -381,6 +426,128 @@ func (m *MetaClient) handleDeleteReaction(tk handlerParams, evt *table.LSDeleteR
 	return m.wrapReaction(tk.Portal, tk.UncertainReceiver, evt.ActorId, 0, evt.MessageId, "")
 }
 
+func (m *MetaClient) handleUpdateOrInsertReactionV2(tk handlerParams, evt *table.LSUpdateOrInsertReactionV2) bridgev2.RemoteEvent {
+	err := m.Main.DB.PutReactionV2(tk.ctx, &metadb.ReactionV2{
+		MessageID:    evt.MessageID,
+		ReactionFBID: evt.ReactionFBID,
+		Reaction:     evt.ReactionLiteral,
+		Count:        evt.Count,
+	})
+	if err != nil {
+		zerolog.Ctx(tk.ctx).Err(err).Str("message_id", evt.MessageID).Msg("Failed to save reaction summary")
+	}
+	m.requestReactionsV2Sync(tk.ctx, tk.Portal, evt.ThreadKey, evt.MessageID)
+	return nil
+}
+
+func (m *MetaClient) handleDeleteReactionV2(tk handlerParams, evt *table.LSDeleteReactionV2) bridgev2.RemoteEvent {
+	err := m.Main.DB.DeleteReactionV2(tk.ctx, evt.MessageID, evt.ReactionFBID)
+	if err != nil {
+		zerolog.Ctx(tk.ctx).Err(err).Str("message_id", evt.MessageID).Msg("Failed to delete reaction summary")
+	}
+	m.requestReactionsV2Sync(tk.ctx, tk.Portal, evt.ThreadKey, evt.MessageID)
+	return nil
+}
+
+func (m *MetaClient) handleReactionV2Detail(tk handlerParams, evt *table.LSDeleteThenInsertReactionsV2Detail) bridgev2.RemoteEvent {
+	summaries, err := m.Main.DB.GetReactionsV2(tk.ctx, evt.MessageID)
+	if err != nil {
+		zerolog.Ctx(tk.ctx).Err(err).Str("message_id", evt.MessageID).Msg("Failed to get reaction summaries")
+		return nil
+	}
+	for _, summary := range summaries {
+		if summary.ReactionFBID == evt.ReactionFBID {
+			reaction := m.wrapReaction(tk.Portal, tk.UncertainReceiver, evt.ReactorID, evt.TimestampMS, evt.MessageID, summary.Reaction)
+			reaction.EmojiID = networkid.EmojiID(summary.Reaction)
+			return reaction
+		}
+	}
+	return nil
+}
+
+// reactionsV2SyncDelay is how long to wait before fetching reaction user lists,
+// so that multiple reaction summary changes to the same message are only fetched once.
+const reactionsV2SyncDelay = 1 * time.Second
+
+func (m *MetaClient) requestReactionsV2Sync(ctx context.Context, portalKey networkid.PortalKey, threadKey int64, messageID string) {
+	if _, alreadyPending := m.pendingReactionSyncs.LoadOrStore(messageID, struct{}{}); alreadyPending {
+		return
+	}
+	go func() {
+		time.Sleep(reactionsV2SyncDelay)
+		m.pendingReactionSyncs.Delete(messageID)
+		m.syncReactionsV2(context.WithoutCancel(ctx), portalKey, threadKey, messageID)
+	}()
+}
+
+func (m *MetaClient) syncReactionsV2(ctx context.Context, portalKey networkid.PortalKey, threadKey int64, messageID string) {
+	log := zerolog.Ctx(ctx).With().
+		Str("action", "sync community reactions").
+		Int64("thread_id", threadKey).
+		Str("message_id", messageID).
+		Logger()
+	summaries, err := m.Main.DB.GetReactionsV2(ctx, messageID)
+	if err != nil {
+		log.Err(err).Msg("Failed to get reaction summaries")
+		return
+	}
+	reactionsByFBID := make(map[int64]string, len(summaries))
+	tasks := make([]socket.Task, len(summaries))
+	for i, summary := range summaries {
+		reactionsByFBID[summary.ReactionFBID] = summary.Reaction
+		tasks[i] = &socket.FetchReactionsV2UserList{
+			ThreadID:     threadKey,
+			MessageID:    messageID,
+			ReactionFBID: &summary.ReactionFBID,
+			SyncGroup:    104,
+		}
+	}
+	syncData := &bridgev2.ReactionSyncData{
+		Users:       make(map[networkid.UserID]*bridgev2.ReactionSyncUser),
+		HasAllUsers: true,
+	}
+	if len(tasks) > 0 {
+		if m.Client == nil || !m.connectWaiter.WaitTimeout(ConnectWaitTimeout) {
+			log.Warn().Msg("Not connected, can't fetch reaction user lists")
+			return
+		}
+		resp, err := m.Client.ExecuteTasks(tasks...)
+		if err != nil {
+			log.Err(err).Msg("Failed to fetch reaction user lists")
+			return
+		}
+		for _, detail := range resp.LSDeleteThenInsertReactionsV2Detail {
+			emoji, ok := reactionsByFBID[detail.ReactionFBID]
+			if !ok || detail.MessageID != messageID {
+				continue
+			}
+			sender := m.makeEventSender(detail.ReactorID)
+			user, ok := syncData.Users[sender.Sender]
+			if !ok {
+				user = &bridgev2.ReactionSyncUser{HasAllReactions: true}
+				syncData.Users[sender.Sender] = user
+			}
+			user.Reactions = append(user.Reactions, &bridgev2.BackfillReaction{
+				Timestamp: time.UnixMilli(detail.TimestampMS),
+				Sender:    sender,
+				EmojiID:   networkid.EmojiID(emoji),
+				Emoji:     emoji,
+			})
+		}
+	}
+	m.Main.Bridge.QueueRemoteEvent(m.UserLogin, &simplevent.ReactionSync{
+		EventMeta: simplevent.EventMeta{
+			Type: bridgev2.RemoteEventReactionSync,
+			LogContext: func(c zerolog.Context) zerolog.Context {
+				return c.Str("target_message_id", messageID)
+			},
+			PortalKey: portalKey,
+		},
+		TargetMessage: metaid.MakeFBMessageID(messageID),
+		Reactions:     syncData,
+	})
+}
+
 func (m *MetaClient) handleUpdateThreadName(tk handlerParams, evt *table.LSSyncUpdateThreadName) bridgev2.RemoteEvent {
 	if tk.Type.IsOneToOne() && !m.Main.Bridge.Config.PrivateChatPortalMeta {
 		return nil
@@ -403,6 +570,29 @@ func (m *MetaClient) handleSetThreadImage(tk handlerParams, evt *table.LSSetThre
 	})
 }
 
+func (m *MetaClient) handleUpdateOrInsertThread(tk handlerParams, evt *table.LSUpdateOrInsertThread) bridgev2.RemoteEvent {
+	if tk.Sync != nil || evt.ThreadType.IsWhatsApp() {
+		// WhatsApp threads get their disappearing timer from the message metadata instead
+		return nil
+	} else if evt.DisappearingSettingUpdatedTs == 0 && evt.DisappearingSettingTtl == 0 {
+		// Partial thread updates don't include the disappearing setting
+		return nil
+	}
+	return m.wrapChatInfoChange(tk.ID, evt.DisappearingSettingUpdatedBy, tk.Type, &bridgev2.ChatInfoChange{
+		ChatInfo: &bridgev2.ChatInfo{
+			Disappear: wrapDisappearingSetting(evt.DisappearingSettingTtl),
+		},
+	})
+}
+
+func (m *MetaClient) handleSetThreadCannotUnsendReason(tk handlerParams, evt *table.LSSetThreadCannotUnsendReason) bridgev2.RemoteEvent {
+	return m.wrapChatInfoChange(evt.ThreadKey, 0, tk.Type, &bridgev2.ChatInfoChange{
+		ChatInfo: &bridgev2.ChatInfo{
+			ExtraUpdates: updateCannotUnsendReason(table.MessageUnsendabilityStatus(evt.CannotUnsendReason)),
+		},
+	})
+}
+
 func (m *MetaClient) handleUpdateMuteSetting(tk handlerParams, evt *table.LSUpdateThreadMuteSetting) bridgev2.RemoteEvent {
 	mutedUntil := time.UnixMilli(evt.MuteExpireTimeMS)
 	if evt.MuteExpireTimeMS < 0 {
@@ -429,13 +619,17 @@ func (m *MetaClient) handleAddParticipant(tk handlerParams, evt *table.LSAddPart
 		tk.Sync.Members[evt.ContactId] = m.wrapChatMember(evt)
 		return nil
 	}
-	return m.wrapChatInfoChange(evt.ThreadKey, evt.ContactId, tk.Type, &bridgev2.ChatInfoChange{
+	member := m.wrapChatMember(evt)
+	memberChange := m.wrapChatInfoChange(evt.ThreadKey, evt.ContactId, tk.Type, &bridgev2.ChatInfoChange{
 		MemberChanges: &bridgev2.ChatMemberList{
-			Members: []bridgev2.ChatMember{
-				m.wrapChatMember(evt),
-			},
+			Members: []bridgev2.ChatMember{member},
 		},
 	})
+	if member.Nickname == nil {
+		return memberChange
+	}
+	m.Main.Bridge.QueueRemoteEvent(m.UserLogin, memberChange)
+	return m.wrapNicknameUpdate(evt.ThreadKey, evt.ContactId, tk.Type, []bridgev2.ChatMember{member})
 }
 
 func (m *MetaClient) handleRemoveParticipant(tk handlerParams, evt *table.LSRemoveParticipantFromThread) bridgev2.RemoteEvent {
@@ -486,15 +680,30 @@ func (m *MetaClient) handleSubthread(ctx context.Context, msg *table.WrappedMess
 func (m *MetaClient) handleMessageInsert(tk handlerParams, msg *table.WrappedMessage) bridgev2.RemoteEvent {
 	m.handleSubthread(tk.ctx, msg)
 	msg.ThreadID = tk.ThreadMsgID
-	return &FBMessageEvent{
+	if msg.IsAdminMessage && isNicknameAdminMessage(msg.Text) && !tk.Type.IsCommunitySpace() && tk.Type != table.COMMUNITY_GROUP {
+		m.refreshParticipants(tk.ctx, tk.ID, tk.Type)
+	}
+	evt := &FBMessageEvent{
 		WrappedMessage:    msg,
 		portalKey:         tk.Portal,
 		uncertainReceiver: tk.UncertainReceiver,
 		m:                 m,
 	}
+	if m.isAIBotThread(tk.Type, tk.Portal) {
+		if msg.SenderId != metaid.ParseUserLoginID(m.UserLogin.ID) {
+			m.flushAIMessagesInPortal(tk.Portal, msg.MessageId)
+			m.bufferAIMessage(tk.ctx, evt)
+			return nil
+		}
+		m.flushAIMessagesInPortal(tk.Portal, "")
+	}
+	return evt
 }
 
 func (m *MetaClient) handleEdit(ctx context.Context, edit *table.LSEditMessage) {
+	if m.updateBufferedAIMessage(edit) {
+		return
+	}
 	editID := metaid.MakeFBMessageID(edit.MessageID)
 	originalMsg, err := m.Main.Bridge.DB.Message.GetFirstPartByID(ctx, m.UserLogin.ID, editID)
 	if err != nil {
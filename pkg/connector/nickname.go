@@ -0,0 +1,150 @@
+package connector
+
+import (
+	"context"
+	"regexp"
+	"time"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/matrix"
+	"maunium.net/go/mautrix/bridgev2/simplevent"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/mautrix-meta/pkg/messagix/socket"
+	"go.mau.fi/mautrix-meta/pkg/messagix/table"
+)
+
+// nicknameAdminMessageRegex matches the admin messages sent for nickname changes, e.g.
+// "Alice set the nickname for Bob to Bobby.", "You set your nickname to Al." or "Alice cleared her nickname."
+var nicknameAdminMessageRegex = regexp.MustCompile(`^.+ (?:set|cleared) (?:the nickname for .+|(?:your|his|her|their) (?:own )?nickname)(?: to .+)?\.?$`)
+
+// isNicknameAdminMessage checks if the text of an admin message is about a nickname change.
+// Admin messages don't have a structured type, so only the English wording is recognized.
+func isNicknameAdminMessage(text string) bool {
+	return nicknameAdminMessageRegex.MatchString(text)
+}
+
+// refreshParticipants fetches the participant list of a thread after a nickname change admin message,
+// as nickname changes are only sent as admin text messages and not as participant updates.
+func (m *MetaClient) refreshParticipants(ctx context.Context, threadKey int64, threadType table.ThreadType) {
+	if _, alreadyPending := m.pendingParticipantSyncs.LoadOrStore(threadKey, struct{}{}); alreadyPending {
+		return
+	}
+	ctx = context.WithoutCancel(ctx)
+	go func() {
+		defer m.pendingParticipantSyncs.Delete(threadKey)
+		log := zerolog.Ctx(ctx).With().
+			Str("action", "refresh participants").
+			Int64("thread_id", threadKey).
+			Logger()
+		resp, err := m.Client.ExecuteTasks(&socket.FetchAdditionalThreadData{ThreadKey: threadKey})
+		if err != nil {
+			log.Err(err).Msg("Failed to fetch thread participants")
+			return
+		}
+		members := make([]bridgev2.ChatMember, 0, len(resp.LSAddParticipantIdToGroupThread))
+		for _, participant := range resp.LSAddParticipantIdToGroupThread {
+			if participant.ThreadKey == threadKey {
+				members = append(members, m.wrapChatMember(participant))
+			}
+		}
+		log.Debug().Int("participant_count", len(members)).Msg("Fetched thread participants")
+		if len(members) == 0 {
+			return
+		}
+		m.Main.Bridge.QueueRemoteEvent(m.UserLogin, m.wrapChatInfoChange(threadKey, 0, threadType, &bridgev2.ChatInfoChange{
+			MemberChanges: &bridgev2.ChatMemberList{Members: members},
+		}))
+		m.Main.Bridge.QueueRemoteEvent(m.UserLogin, m.wrapNicknameUpdate(threadKey, 0, threadType, members))
+	}()
+}
+
+// wrapNicknameUpdate wraps a nickname updater in a separate chat info change event. Chat info changes
+// are applied before member changes, so nicknames must be queued after the member change event to
+// apply to members that the member change adds to the room.
+func (m *MetaClient) wrapNicknameUpdate(threadKey, participantID int64, threadType table.ThreadType, members []bridgev2.ChatMember) *simplevent.ChatInfoChange {
+	return m.wrapChatInfoChange(threadKey, participantID, threadType, &bridgev2.ChatInfoChange{
+		ChatInfo: &bridgev2.ChatInfo{ExtraUpdates: m.nicknameUpdater(members)},
+	})
+}
+
+// nicknameUpdater returns a portal info updater that applies the Meta nicknames of the given members as
+// per-room displaynames. Members without nickname info are skipped, while empty nicknames reset the
+// displayname back to the normal name.
+//
+// Nicknames are only bridged from Meta to Matrix: the socket task for setting them hasn't been confirmed
+// from a captured payload. Encrypted (WhatsApp transport) chats don't include nicknames at all.
+func (m *MetaClient) nicknameUpdater(members []bridgev2.ChatMember) bridgev2.ExtraUpdater[*bridgev2.Portal] {
+	return func(ctx context.Context, portal *bridgev2.Portal) bool {
+		if portal.MXID == "" {
+			return false
+		}
+		for _, member := range members {
+			if member.Nickname != nil {
+				m.setRoomNickname(ctx, portal, member.EventSender, *member.Nickname)
+			}
+		}
+		return false
+	}
+}
+
+func (m *MetaClient) setRoomNickname(ctx context.Context, portal *bridgev2.Portal, sender bridgev2.EventSender, nickname string) {
+	log := zerolog.Ctx(ctx).With().Str("user_id", string(sender.Sender)).Logger()
+	var intent bridgev2.MatrixAPI
+	var userID id.UserID
+	displayname := nickname
+	if sender.IsFromMe {
+		intent = m.UserLogin.User.DoublePuppet(ctx)
+		if intent == nil {
+			return
+		}
+		userID = m.UserLogin.UserMXID
+	} else {
+		ghost, err := m.Main.Bridge.GetGhostByID(ctx, sender.Sender)
+		if err != nil {
+			log.Err(err).Msg("Failed to get ghost to update nickname")
+			return
+		}
+		intent = ghost.Intent
+		userID = ghost.Intent.GetMXID()
+		if displayname == "" {
+			displayname = ghost.Name
+		}
+	}
+	current, err := m.Main.Bridge.Matrix.GetMemberInfo(ctx, portal.MXID, userID)
+	if err != nil {
+		log.Err(err).Msg("Failed to get member info to update nickname")
+		return
+	} else if current == nil || current.Membership != event.MembershipJoin || current.Displayname == displayname {
+		return
+	}
+	if displayname == "" && sender.IsFromMe {
+		displayname = m.getGlobalDisplayname(ctx, userID)
+	}
+	if displayname == "" || current.Displayname == displayname {
+		return
+	}
+	content := *current
+	content.Displayname = displayname
+	_, err = intent.SendState(ctx, portal.MXID, event.StateMember, userID.String(), &event.Content{Parsed: &content}, time.Time{})
+	if err != nil {
+		log.Err(err).Msg("Failed to update per-room displayname")
+	} else {
+		log.Debug().Str("nickname", nickname).Msg("Updated per-room displayname")
+	}
+}
+
+func (m *MetaClient) getGlobalDisplayname(ctx context.Context, userID id.UserID) string {
+	mc, ok := m.Main.Bridge.Matrix.(*matrix.Connector)
+	if !ok {
+		return ""
+	}
+	resp, err := mc.Bot.GetDisplayName(ctx, userID)
+	if err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Stringer("user_id", userID).Msg("Failed to get global displayname of user")
+		return ""
+	}
+	return resp.DisplayName
+}
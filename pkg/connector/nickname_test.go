@@ -0,0 +1,32 @@
+package connector
+
+import (
+	"testing"
+)
+
+func TestIsNicknameAdminMessage(t *testing.T) {
+	for _, text := range []string{
+		"Alice set the nickname for Bob to Bobby.",
+		"You set the nickname for Bob to Bobby",
+		"You set your nickname to Al.",
+		"Alice set her own nickname to Al.",
+		"Alice set your nickname to Al",
+		"Alice cleared the nickname for Bob.",
+		"You cleared your nickname.",
+	} {
+		if !isNicknameAdminMessage(text) {
+			t.Errorf("expected %q to be a nickname change", text)
+		}
+	}
+	for _, text := range []string{
+		"Alice named the group Nickname ideas.",
+		"Alice changed the theme to nickname.",
+		"Alice added Bob to the group.",
+		"nickname",
+		"",
+	} {
+		if isNicknameAdminMessage(text) {
+			t.Errorf("expected %q not to be a nickname change", text)
+		}
+	}
+}
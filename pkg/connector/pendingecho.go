@@ -0,0 +1,131 @@
+package connector
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/event"
+
+	"go.mau.fi/mautrix-meta/pkg/metaid"
+)
+
+const pendingEchoTimeout = 10 * time.Minute
+
+var ErrTargetStillSending = bridgev2.WrapErrorInStatus(errors.New("target message hasn't been confirmed by Meta yet, try again in a moment")).
+	WithStatus(event.MessageStatusRetriable).WithErrorAsMessage().WithSendNotice(true)
+
+// pendingEcho is a message sent from Matrix whose echo from Meta hasn't been received yet.
+// Send responses don't include a timestamp and sometimes don't include the message ID either,
+// so those are patched in when the echo arrives.
+type pendingEcho struct {
+	// The ID the message was saved with, either the real ID or a placeholder from metaid.MakePendingMessageID.
+	// Empty if the message hasn't been saved yet.
+	MessageID networkid.MessageID
+	// RealID is the real message ID if it was received before the echo itself (e.g. from a send result).
+	RealID string
+	Added  time.Time
+}
+
+func (m *MetaClient) addPendingEcho(otid string) {
+	m.pendingEchoesLock.Lock()
+	defer m.pendingEchoesLock.Unlock()
+	for key, echo := range m.pendingEchoes {
+		if time.Since(echo.Added) > pendingEchoTimeout {
+			delete(m.pendingEchoes, key)
+		}
+	}
+	if _, ok := m.pendingEchoes[otid]; !ok {
+		m.pendingEchoes[otid] = &pendingEcho{Added: time.Now()}
+	}
+}
+
+// setPendingEchoID stores the ID that the given message was saved with and returns it.
+// If the real message ID is unknown, a placeholder ID is used.
+func (m *MetaClient) setPendingEchoID(otid, msgID string) networkid.MessageID {
+	dbID := metaid.MakePendingMessageID(otid)
+	if msgID != "" {
+		dbID = metaid.MakeFBMessageID(msgID)
+	}
+	m.pendingEchoesLock.Lock()
+	defer m.pendingEchoesLock.Unlock()
+	if echo, ok := m.pendingEchoes[otid]; ok {
+		echo.MessageID = dbID
+	}
+	return dbID
+}
+
+// setPendingEchoRealID stores the real message ID of a sent message that was saved with a placeholder ID,
+// so that operations targeting the placeholder can be sent before the echo arrives.
+func (m *MetaClient) setPendingEchoRealID(otid, msgID string) {
+	m.pendingEchoesLock.Lock()
+	defer m.pendingEchoesLock.Unlock()
+	if echo, ok := m.pendingEchoes[otid]; ok {
+		echo.RealID = msgID
+	}
+}
+
+// resolveMessageID parses the given message ID, resolving placeholder IDs to the real message ID if it's known.
+// If the message is still waiting for its real ID, a retriable error is returned.
+func (m *MetaClient) resolveMessageID(messageID networkid.MessageID) (metaid.ParsedMessageID, error) {
+	parsed := metaid.ParseMessageID(messageID)
+	pending, ok := parsed.(metaid.ParsedPendingMessageID)
+	if !ok {
+		return parsed, nil
+	} else if echo := m.getPendingEcho(pending.OTID); echo != nil && echo.RealID != "" {
+		return metaid.ParsedFBMessageID{ID: echo.RealID}, nil
+	}
+	return nil, ErrTargetStillSending
+}
+
+// resolveTargetMessage returns the given message with its placeholder ID replaced by the real message ID,
+// so that it can be referenced in tasks sent to Meta (e.g. as a reply target or thread root).
+// The message is copied instead of being modified, as the real ID is only saved when the echo arrives.
+func (m *MetaClient) resolveTargetMessage(msg *database.Message) (*database.Message, error) {
+	if msg == nil {
+		return nil, nil
+	} else if _, isPending := metaid.ParseMessageID(msg.ID).(metaid.ParsedPendingMessageID); !isPending {
+		return msg, nil
+	}
+	parsed, err := m.resolveMessageID(msg.ID)
+	if err != nil {
+		return nil, err
+	}
+	resolved := *msg
+	resolved.ID = metaid.MakeFBMessageID(parsed.(metaid.ParsedFBMessageID).ID)
+	return &resolved, nil
+}
+
+func (m *MetaClient) getPendingEcho(otid string) *pendingEcho {
+	if otid == "" {
+		return nil
+	}
+	m.pendingEchoesLock.Lock()
+	defer m.pendingEchoesLock.Unlock()
+	return m.pendingEchoes[otid]
+}
+
+func (m *MetaClient) removePendingEcho(otid string) {
+	m.pendingEchoesLock.Lock()
+	delete(m.pendingEchoes, otid)
+	m.pendingEchoesLock.Unlock()
+}
+
+func (evt *FBMessageEvent) HandleExisting(ctx context.Context, portal *bridgev2.Portal, intent bridgev2.MatrixAPI, existing []*database.Message) (bridgev2.UpsertResult, error) {
+	evt.m.removePendingEcho(evt.OfflineThreadingId)
+	realID := metaid.MakeFBMessageID(evt.MessageId)
+	ts := time.UnixMilli(evt.TimestampMs)
+	zerolog.Ctx(ctx).Debug().
+		Str("prev_message_id", string(existing[0].ID)).
+		Time("prev_timestamp", existing[0].Timestamp).
+		Msg("Received echo for sent message, updating ID and timestamp")
+	for _, part := range existing {
+		part.ID = realID
+		part.Timestamp = ts
+	}
+	return bridgev2.UpsertResult{SaveParts: true}, nil
+}
@@ -0,0 +1,38 @@
+package connector
+
+import (
+	"testing"
+
+	"maunium.net/go/mautrix/bridgev2/database"
+
+	"go.mau.fi/mautrix-meta/pkg/metaid"
+)
+
+func TestResolveTargetMessage(t *testing.T) {
+	m := &MetaClient{pendingEchoes: make(map[string]*pendingEcho)}
+	m.addPendingEcho("123")
+	m.setPendingEchoID("123", "")
+	pending := &database.Message{ID: metaid.MakePendingMessageID("123"), MXID: "$event"}
+
+	if _, err := m.resolveTargetMessage(pending); err == nil {
+		t.Fatal("expected error for unconfirmed message")
+	}
+
+	m.setPendingEchoRealID("123", "mid.$abc")
+	resolved, err := m.resolveTargetMessage(pending)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else if resolved.ID != metaid.MakeFBMessageID("mid.$abc") || resolved.MXID != pending.MXID {
+		t.Fatalf("unexpected resolved message %+v", resolved)
+	} else if pending.ID != metaid.MakePendingMessageID("123") {
+		t.Fatal("resolving modified the original message")
+	}
+
+	normal := &database.Message{ID: metaid.MakeFBMessageID("mid.$def")}
+	if resolved, err = m.resolveTargetMessage(normal); err != nil || resolved != normal {
+		t.Fatalf("expected normal message to be returned as-is, got %+v, %v", resolved, err)
+	}
+	if resolved, err = m.resolveTargetMessage(nil); err != nil || resolved != nil {
+		t.Fatalf("expected nil for nil message, got %+v, %v", resolved, err)
+	}
+}
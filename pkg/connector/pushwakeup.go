@@ -0,0 +1,265 @@
+package connector
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog"
+	"go.mau.fi/util/random"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+
+	"go.mau.fi/mautrix-meta/pkg/messagix/cookies"
+)
+
+const (
+	pushPathPrefix      = "/_meta/push"
+	maxPushBodySize     = 8 * 1024
+	idleCheckInterval   = 1 * time.Minute
+	pushContentEncoding = "aes128gcm"
+)
+
+func (m *MetaConnector) registerPushHandler() error {
+	server, ok := m.Bridge.Matrix.(bridgev2.MatrixConnectorWithServer)
+	if !ok || server.GetPublicAddress() == "" {
+		return errors.New("push_wakeup requires the appservice public address to be configured")
+	}
+	server.GetRouter().HandleFunc(pushPathPrefix+"/{loginID}/{secret}", m.handlePushRequest).Methods(http.MethodPost)
+	return nil
+}
+
+// handlePushRequest receives web push messages sent by Meta (through the browser push service protocol).
+func (m *MetaConnector) handlePushRequest(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	login := m.Bridge.GetCachedUserLoginByID(networkid.UserLoginID(vars["loginID"]))
+	if login == nil {
+		// 410 tells the push service to drop the subscription
+		w.WriteHeader(http.StatusGone)
+		return
+	}
+	client, ok := login.Client.(*MetaClient)
+	if !ok || client.LoginMeta.PushKeys == nil || client.LoginMeta.PushSecret == "" ||
+		subtle.ConstantTimeCompare([]byte(client.LoginMeta.PushSecret), []byte(vars["secret"])) != 1 {
+		w.WriteHeader(http.StatusGone)
+		return
+	}
+	log := login.Log.With().Str("action", "handle push").Logger()
+	payload, statusCode := readPushPayload(r, client.LoginMeta.PushKeys, &log)
+	w.WriteHeader(statusCode)
+	if payload != nil {
+		go client.handlePush(log.WithContext(context.Background()), payload)
+	}
+}
+
+// readPushPayload reads and decrypts the body of a web push request. The returned status code should be sent
+// to the push service regardless of whether decrypting succeeded.
+func readPushPayload(r *http.Request, keys *cookies.PushKeys, log *zerolog.Logger) ([]byte, int) {
+	if encoding := r.Header.Get("Content-Encoding"); encoding != pushContentEncoding {
+		log.Warn().Str("content_encoding", encoding).Msg("Unsupported push content encoding")
+		return nil, http.StatusUnsupportedMediaType
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxPushBodySize))
+	if err != nil {
+		log.Err(err).Msg("Failed to read push body")
+		return nil, http.StatusBadRequest
+	}
+	payload, err := keys.DecryptPush(body)
+	if err != nil {
+		log.Err(err).Msg("Failed to decrypt push")
+		return nil, http.StatusBadRequest
+	}
+	return payload, http.StatusCreated
+}
+
+type pushNotification struct {
+	Title  string         `json:"title"`
+	Body   string         `json:"body"`
+	Params map[string]any `json:"params"`
+}
+
+// isSilent checks if the push has nothing to show to the user. Only new messages are shown as notifications,
+// so silent pushes (like typing notifications and read receipts) don't need to wake up the login.
+func (pn *pushNotification) isSilent() bool {
+	return pn.Title == "" && pn.Body == ""
+}
+
+// threadID finds the thread that the push is about. The param keys haven't been confirmed from a captured
+// Meta push, so all likely keys are checked. If none of them are present, the thread isn't fetched separately,
+// but the resumed socket sync still delivers the message.
+func (pn *pushNotification) threadID() int64 {
+	for _, key := range []string{"thread_id", "thread_fbid", "thread_key", "tid"} {
+		switch val := pn.Params[key].(type) {
+		case string:
+			parsed, err := strconv.ParseInt(val, 10, 64)
+			if err == nil {
+				return parsed
+			}
+		case float64:
+			return int64(val)
+		}
+	}
+	return 0
+}
+
+// handlePush wakes up a sleeping login when a message push is received. Waking up reconnects the socket,
+// which syncs all mailbox changes since the login went to sleep. The thread that the push is about is
+// additionally fetched directly, so the pushed message is bridged even if the resumed sync is slow.
+func (m *MetaClient) handlePush(ctx context.Context, payload []byte) {
+	log := zerolog.Ctx(ctx)
+	var notif pushNotification
+	err := json.Unmarshal(payload, &notif)
+	if err != nil {
+		// Wake up anyway, as it's better to reconnect unnecessarily than to miss messages
+		log.Warn().Err(err).Msg("Failed to parse push payload")
+	} else if notif.isSilent() {
+		log.Debug().Msg("Ignoring silent push notification")
+		log.Trace().RawJSON("payload", payload).Msg("Silent push notification payload")
+		return
+	}
+	threadID := notif.threadID()
+	sleeping := m.pushSleeping.Load()
+	log.Debug().
+		Int64("thread_id", threadID).
+		Bool("sleeping", sleeping).
+		Msg("Received push notification")
+	log.Trace().RawJSON("payload", payload).Msg("Push notification payload")
+	if !sleeping {
+		// The socket is connected, so the message will arrive (or has already arrived) through it
+		return
+	}
+	if m.wakeUp(ctx, "push") && threadID != 0 {
+		m.syncThreadAfterPush(ctx, threadID)
+	}
+}
+
+// syncThreadAfterPush fetches the latest messages in the thread that triggered a push notification.
+// The messages are bridged through the normal upsert handling, which backfills any gap in the portal.
+func (m *MetaClient) syncThreadAfterPush(ctx context.Context, threadID int64) {
+	if !m.connectWaiter.WaitTimeout(ConnectWaitTimeout) {
+		zerolog.Ctx(ctx).Warn().Int64("thread_id", threadID).Msg("Not syncing thread after push as connection timed out")
+		return
+	}
+	m.requestMoreHistory(ctx, threadID, 1, time.Now().UnixMilli(), "")
+}
+
+func (m *MetaClient) pushEndpoint() string {
+	server := m.Main.Bridge.Matrix.(bridgev2.MatrixConnectorWithServer)
+	return fmt.Sprintf("%s%s/%s/%s", server.GetPublicAddress(), pushPathPrefix, m.UserLogin.ID, m.LoginMeta.PushSecret)
+}
+
+func (m *MetaClient) registerPush(ctx context.Context) error {
+	if m.LoginMeta.PushKeys == nil || m.LoginMeta.PushSecret == "" {
+		err := m.LoginMeta.Cookies.GeneratePushKeys()
+		if err != nil {
+			return fmt.Errorf("failed to generate push keys: %w", err)
+		}
+		m.LoginMeta.PushKeys = m.LoginMeta.Cookies.PushKeys
+		m.LoginMeta.PushSecret = random.String(32)
+		err = m.UserLogin.Save(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to save push keys: %w", err)
+		}
+	}
+	m.LoginMeta.Cookies.PushKeys = m.LoginMeta.PushKeys
+	if m.LoginMeta.Platform.IsMessenger() {
+		return m.Client.Facebook.RegisterPushNotifications(m.pushEndpoint())
+	}
+	return m.Client.Instagram.RegisterPushNotifications(m.pushEndpoint())
+}
+
+// markActive resets the idle timer and wakes up the connection if it was disconnected for being idle.
+func (m *MetaClient) markActive() {
+	m.lastActivity.Store(time.Now().UnixMilli())
+	if m.pushSleeping.Load() {
+		go m.wakeUp(m.UserLogin.Log.WithContext(context.Background()), "activity")
+	}
+}
+
+func (m *MetaClient) idleDisconnectLoop() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if oldCancel := m.stopIdleLoop.Swap(&cancel); oldCancel != nil {
+		(*oldCancel)()
+	}
+	m.lastActivity.Store(time.Now().UnixMilli())
+	idleTimeout := time.Duration(m.Main.Config.PushWakeupIdleSeconds) * time.Second
+	ticker := time.NewTicker(idleCheckInterval)
+	defer ticker.Stop()
+	ctx = m.UserLogin.Log.With().Str("action", "idle disconnect loop").Logger().WithContext(ctx)
+	for {
+		select {
+		case <-ticker.C:
+			if !m.pushSleeping.Load() && m.connectWaiter.IsSet() && time.Since(time.UnixMilli(m.lastActivity.Load())) > idleTimeout {
+				m.sleepUntilPush(ctx)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// sleepUntilPush registers a web push endpoint and then closes the connections to Meta until a push is received
+// or the user does something on Matrix.
+func (m *MetaClient) sleepUntilPush(ctx context.Context) {
+	log := zerolog.Ctx(ctx)
+	cli := m.Client
+	if cli == nil {
+		return
+	}
+	err := m.registerPush(ctx)
+	if err != nil {
+		log.Err(err).Msg("Failed to register for push notifications, staying connected")
+		m.lastActivity.Store(time.Now().UnixMilli())
+		return
+	}
+	m.pushSleeping.Store(true)
+	// Periodic reconnects would wake the login up again, so stop them until the next wakeup
+	if stopPeriodicReconnect := m.stopPeriodicReconnect.Swap(nil); stopPeriodicReconnect != nil {
+		(*stopPeriodicReconnect)()
+	}
+	m.connectWaiter.Clear()
+	m.e2eeConnectWaiter.Clear()
+	cli.Disconnect()
+	if ecli := m.E2EEClient; ecli != nil {
+		ecli.Disconnect()
+	}
+	log.Info().Msg("Disconnected idle login, waiting for push notifications")
+}
+
+// wakeUp reconnects a login that was disconnected for being idle. The socket resumes from the previous sync
+// cursors, so the mailbox changes of all threads since disconnecting are synced, not only the pushed thread.
+// The return value is true if this call started a reconnect.
+func (m *MetaClient) wakeUp(ctx context.Context, reason string) bool {
+	if !m.pushSleeping.CompareAndSwap(true, false) {
+		return false
+	}
+	log := zerolog.Ctx(ctx)
+	m.lastActivity.Store(time.Now().UnixMilli())
+	cli := m.Client
+	if cli == nil {
+		return false
+	}
+	log.Info().Str("reason", reason).Msg("Waking up idle login")
+	err := cli.Connect()
+	if err != nil {
+		log.Err(err).Msg("Failed to reconnect socket after idle, doing full reconnect")
+		m.FullReconnect()
+		return true
+	}
+	if ecli := m.E2EEClient; ecli != nil {
+		err = ecli.Connect()
+		if err != nil {
+			log.Err(err).Msg("Failed to reconnect to e2ee socket after idle")
+		}
+	}
+	go m.periodicReconnect()
+	return true
+}
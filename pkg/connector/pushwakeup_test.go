@@ -0,0 +1,108 @@
+package connector
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridgev2"
+)
+
+func newTestPushClient(sleeping bool) *MetaClient {
+	m := &MetaClient{UserLogin: &bridgev2.UserLogin{Log: zerolog.Nop()}}
+	m.pushSleeping.Store(sleeping)
+	return m
+}
+
+func TestHandlePushIgnoresSilentPush(t *testing.T) {
+	m := newTestPushClient(true)
+	for _, payload := range []string{
+		`{}`,
+		`{"params":{"thread_id":"123"}}`,
+		`{"title":"","body":"","params":{"type":"typing"}}`,
+	} {
+		m.handlePush(context.Background(), []byte(payload))
+		if !m.pushSleeping.Load() {
+			t.Fatalf("silent push %s woke up the login", payload)
+		}
+	}
+}
+
+func TestHandlePushWakesUpSleepingLogin(t *testing.T) {
+	for _, payload := range []string{
+		`{"title":"Alice","body":"hello","params":{"thread_id":"123"}}`,
+		`{"body":"Alice sent an attachment."}`,
+		// Unparseable pushes wake up the login to avoid missing messages
+		`not json`,
+	} {
+		m := newTestPushClient(true)
+		m.handlePush(context.Background(), []byte(payload))
+		if m.pushSleeping.Load() {
+			t.Errorf("push %s didn't wake up the login", payload)
+		} else if m.lastActivity.Load() == 0 {
+			t.Errorf("push %s didn't reset the idle timer", payload)
+		}
+	}
+}
+
+func TestHandlePushWhileAwake(t *testing.T) {
+	m := newTestPushClient(false)
+	m.handlePush(context.Background(), []byte(`{"title":"Alice","body":"hello"}`))
+	if m.pushSleeping.Load() {
+		t.Fatal("push put an awake login to sleep")
+	} else if m.lastActivity.Load() != 0 {
+		t.Fatal("push to an awake login was treated as a wakeup")
+	}
+}
+
+func TestWakeUpOnlyOnce(t *testing.T) {
+	m := newTestPushClient(true)
+	m.wakeUp(context.Background(), "test")
+	if m.pushSleeping.Load() {
+		t.Fatal("wakeUp didn't clear the sleeping flag")
+	}
+	m.lastActivity.Store(0)
+	m.wakeUp(context.Background(), "test")
+	if m.lastActivity.Load() != 0 {
+		t.Fatal("wakeUp of an awake login was treated as a wakeup")
+	}
+}
+
+func TestMarkActiveWakesUp(t *testing.T) {
+	m := newTestPushClient(true)
+	m.markActive()
+	deadline := time.Now().Add(time.Second)
+	for m.pushSleeping.Load() {
+		if time.Now().After(deadline) {
+			t.Fatal("markActive didn't wake up the sleeping login")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSleepUntilPushWithoutClient(t *testing.T) {
+	m := newTestPushClient(false)
+	m.sleepUntilPush(context.Background())
+	if m.pushSleeping.Load() {
+		t.Fatal("login without a client went to sleep")
+	}
+}
+
+func TestPushNotificationThreadID(t *testing.T) {
+	cases := []struct {
+		params   map[string]any
+		expected int64
+	}{
+		{map[string]any{"thread_id": "1234567890"}, 1234567890},
+		{map[string]any{"tid": float64(42)}, 42},
+		{map[string]any{"thread_key": "not a number", "thread_fbid": "5"}, 5},
+		{map[string]any{"other": "1"}, 0},
+	}
+	for _, c := range cases {
+		pn := &pushNotification{Params: c.params}
+		if threadID := pn.threadID(); threadID != c.expected {
+			t.Errorf("expected thread ID %d for %v, got %d", c.expected, c.params, threadID)
+		}
+	}
+}
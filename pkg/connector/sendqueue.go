@@ -0,0 +1,328 @@
+package connector
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridge/status"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/event"
+
+	"go.mau.fi/mautrix-meta/pkg/messagix/socket"
+	"go.mau.fi/mautrix-meta/pkg/messagix/table"
+	"go.mau.fi/mautrix-meta/pkg/metadb"
+)
+
+const (
+	maxOutgoingAttempts = 10
+	maxOutgoingAge      = 24 * time.Hour
+)
+
+var ErrOutgoingExpired = bridgev2.WrapErrorInStatus(errors.New("message couldn't be sent in time")).WithErrorAsMessage().WithSendNotice(true)
+
+// enqueueOutgoing stores the tasks of an outgoing message in the database, so that sending can be retried with
+// the same OTID even after a reconnect or restart. Meta deduplicates messages by OTID, so retries are idempotent.
+func (m *MetaClient) enqueueOutgoing(ctx context.Context, msg *bridgev2.MatrixMessage, otid int64, tasks []socket.Task) error {
+	rawTasks := make([]*socket.RawTask, len(tasks))
+	for i, task := range tasks {
+		var err error
+		rawTasks[i], err = socket.NewRawTask(task)
+		if err != nil {
+			return fmt.Errorf("failed to serialize task %s: %w", task.GetLabel(), err)
+		}
+	}
+	tasksJSON, err := json.Marshal(rawTasks)
+	if err != nil {
+		return fmt.Errorf("failed to marshal tasks: %w", err)
+	}
+	return m.Main.DB.PutOutgoingMessage(ctx, &metadb.OutgoingMessage{
+		OTID:       otid,
+		LoginID:    m.UserLogin.ID,
+		Portal:     msg.Portal.PortalKey,
+		RoomID:     msg.Event.RoomID,
+		EventID:    msg.Event.ID,
+		SenderMXID: msg.Event.Sender,
+		Tasks:      tasksJSON,
+		CreatedAt:  time.Now(),
+	})
+}
+
+// markOutgoingInFlight marks the given OTID as being sent by this process.
+// The returned bool is false if it was already in flight.
+func (m *MetaClient) markOutgoingInFlight(otid int64) bool {
+	m.outgoingLock.Lock()
+	defer m.outgoingLock.Unlock()
+	if _, inFlight := m.outgoingInFlight[otid]; inFlight {
+		return false
+	}
+	m.outgoingInFlight[otid] = struct{}{}
+	return true
+}
+
+func (m *MetaClient) unmarkOutgoingInFlight(otid int64) {
+	m.outgoingLock.Lock()
+	delete(m.outgoingInFlight, otid)
+	m.outgoingLock.Unlock()
+}
+
+func (m *MetaClient) isOutgoingInFlight(otid int64) bool {
+	m.outgoingLock.Lock()
+	_, inFlight := m.outgoingInFlight[otid]
+	m.outgoingLock.Unlock()
+	return inFlight
+}
+
+// parseSendResponse finds the message ID and timestamp for the given OTID in the response to a send.
+// The timestamp is zero if the response didn't include the message itself.
+// If the server rejected the message, the returned error wraps ErrServerRejectedMessage.
+func parseSendResponse(log *zerolog.Logger, resp *table.LSTable, otidStr string) (string, time.Time, error) {
+	var ts time.Time
+	if msg := findSentMessage(resp, otidStr); msg != nil {
+		ts = time.UnixMilli(msg.TimestampMs)
+	}
+	for _, replace := range resp.LSReplaceOptimsiticMessage {
+		if replace.OfflineThreadingId == otidStr {
+			return replace.MessageId, ts, nil
+		}
+	}
+	for _, failed := range resp.LSMarkOptimisticMessageFailed {
+		if failed.OTID == otidStr {
+			log.Warn().Str("message", failed.Message).Msg("Sending message failed (optimistic)")
+			return "", ts, fmt.Errorf("%w: %s", ErrServerRejectedMessage, failed.Message)
+		}
+	}
+	for _, failed := range resp.LSHandleFailedTask {
+		if failed.OTID == otidStr {
+			log.Warn().Str("message", failed.Message).Msg("Sending message failed (task)")
+			return "", ts, fmt.Errorf("%w: %s", ErrServerRejectedMessage, failed.Message)
+		}
+	}
+	log.Warn().Msg("Message send response didn't include message ID")
+	return "", ts, nil
+}
+
+// findSentMessage finds the message with the given OTID in a send response.
+func findSentMessage(resp *table.LSTable, otidStr string) *table.WrappedMessage {
+	upsert, insert := resp.WrapMessages()
+	for _, msg := range insert {
+		if msg.OfflineThreadingId == otidStr {
+			return msg
+		}
+	}
+	for _, msgs := range upsert {
+		for _, msg := range msgs.Messages {
+			if msg.OfflineThreadingId == otidStr {
+				return msg
+			}
+		}
+	}
+	return nil
+}
+
+// flushOutgoingQueue retries sending all queued messages. It's called whenever the Meta socket (re)connects.
+func (m *MetaClient) flushOutgoingQueue(ctx context.Context) {
+	if !m.flushOutgoingLock.TryLock() {
+		return
+	}
+	defer m.flushOutgoingLock.Unlock()
+	log := zerolog.Ctx(ctx)
+	queued, err := m.Main.DB.GetOutgoingMessages(ctx, m.UserLogin.ID)
+	if err != nil {
+		log.Err(err).Msg("Failed to get queued outgoing messages")
+		return
+	} else if len(queued) == 0 {
+		return
+	}
+	log.Debug().Int("count", len(queued)).Msg("Retrying queued outgoing messages")
+	for _, entry := range queued {
+		if !m.markOutgoingInFlight(entry.OTID) {
+			continue
+		}
+		ok := m.retryOutgoing(ctx, entry)
+		m.unmarkOutgoingInFlight(entry.OTID)
+		if !ok {
+			// The connection broke again, the rest will be retried after the next reconnect
+			return
+		}
+	}
+}
+
+// makeOutgoingEvent makes a stub Matrix message for a queued message, which is used to tell the portal
+// to save the message when its echo arrives after the original Matrix event is gone (e.g. after a restart).
+func (m *MetaClient) makeOutgoingEvent(ctx context.Context, entry *metadb.OutgoingMessage) (*bridgev2.MatrixMessage, error) {
+	portal, err := m.Main.Bridge.GetExistingPortalByKey(ctx, entry.Portal)
+	if err != nil {
+		return nil, err
+	} else if portal == nil {
+		return nil, fmt.Errorf("portal not found")
+	}
+	content := &event.MessageEventContent{}
+	return &bridgev2.MatrixMessage{
+		MatrixEventBase: bridgev2.MatrixEventBase[*event.MessageEventContent]{
+			Event: &event.Event{
+				ID:        entry.EventID,
+				RoomID:    entry.RoomID,
+				Sender:    entry.SenderMXID,
+				Type:      event.EventMessage,
+				Timestamp: entry.CreatedAt.UnixMilli(),
+				Content:   event.Content{Parsed: content},
+			},
+			Content: content,
+			Portal:  portal,
+		},
+	}, nil
+}
+
+// retryOutgoing sends a single queued message. The returned bool is false if sending failed due to a connection
+// error, in which case the message stays in the queue.
+func (m *MetaClient) retryOutgoing(ctx context.Context, entry *metadb.OutgoingMessage) bool {
+	log := zerolog.Ctx(ctx).With().Int64("otid", entry.OTID).Stringer("event_id", entry.EventID).Logger()
+	ctx = log.WithContext(ctx)
+	if entry.Attempts >= maxOutgoingAttempts || time.Since(entry.CreatedAt) > maxOutgoingAge {
+		log.Warn().Int("attempts", entry.Attempts).Time("created_at", entry.CreatedAt).Msg("Giving up on queued outgoing message")
+		m.failOutgoing(ctx, entry, ErrOutgoingExpired)
+		return true
+	}
+	var rawTasks []*socket.RawTask
+	err := json.Unmarshal(entry.Tasks, &rawTasks)
+	if err != nil {
+		log.Err(err).Msg("Failed to unmarshal queued tasks")
+		m.failOutgoing(ctx, entry, err)
+		return true
+	}
+	tasks := make([]socket.Task, len(rawTasks))
+	for i, task := range rawTasks {
+		tasks[i] = task
+	}
+	otidStr := strconv.FormatInt(entry.OTID, 10)
+	if m.getPendingEcho(otidStr) == nil {
+		// The message was queued before a restart, so the portal doesn't know to expect the echo
+		evt, err := m.makeOutgoingEvent(ctx, entry)
+		if err != nil {
+			log.Err(err).Msg("Failed to get portal of queued message")
+			m.failOutgoing(ctx, entry, err)
+			return true
+		}
+		evt.AddPendingToSave(&database.Message{SenderID: networkid.UserID(m.UserLogin.ID)}, networkid.TransactionID(otidStr), nil)
+		m.addPendingEcho(otidStr)
+	}
+	err = m.Main.DB.IncrementOutgoingMessageAttempts(ctx, entry.OTID)
+	if err != nil {
+		log.Err(err).Msg("Failed to increment send attempt counter")
+	}
+	log.Debug().Int("attempt", entry.Attempts+1).Msg("Retrying queued outgoing message")
+	resp, err := m.Client.ExecuteTasks(tasks...)
+	if err != nil {
+		log.Err(err).Msg("Failed to send queued message to Meta")
+		return false
+	}
+	log.Trace().Any("response", resp).Msg("Meta send response")
+	_, _, err = parseSendResponse(&log, resp, otidStr)
+	if err != nil {
+		m.failOutgoing(ctx, entry, err)
+	} else {
+		m.finishOutgoing(ctx, entry, findSentMessage(resp, otidStr))
+	}
+	return true
+}
+
+// reconcileOutgoing handles send results that arrive through the socket instead of as a response to the send,
+// e.g. when the response was lost in a reconnect.
+func (m *MetaClient) reconcileOutgoing(ctx context.Context, tbl *table.LSTable) {
+	for _, replace := range tbl.LSReplaceOptimsiticMessage {
+		m.setPendingEchoRealID(replace.OfflineThreadingId, replace.MessageId)
+		m.reconcileOutgoingResult(ctx, replace.OfflineThreadingId, replace.MessageId, nil)
+	}
+	for _, failed := range tbl.LSMarkOptimisticMessageFailed {
+		m.reconcileOutgoingResult(ctx, failed.OTID, "", fmt.Errorf("%w: %s", ErrServerRejectedMessage, failed.Message))
+	}
+	for _, failed := range tbl.LSHandleFailedTask {
+		m.reconcileOutgoingResult(ctx, failed.OTID, "", fmt.Errorf("%w: %s", ErrServerRejectedMessage, failed.Message))
+	}
+}
+
+func (m *MetaClient) reconcileOutgoingResult(ctx context.Context, otidStr, msgID string, sendErr error) {
+	otid, _ := strconv.ParseInt(otidStr, 10, 64)
+	if otid == 0 || (msgID == "" && sendErr == nil) || m.isOutgoingInFlight(otid) {
+		// In-flight messages are finished by whoever is sending them
+		return
+	}
+	log := zerolog.Ctx(ctx).With().Int64("otid", otid).Logger()
+	ctx = log.WithContext(ctx)
+	entry, err := m.Main.DB.GetOutgoingMessage(ctx, otid)
+	if err != nil {
+		log.Err(err).Msg("Failed to get queued outgoing message")
+		return
+	} else if entry == nil || entry.LoginID != m.UserLogin.ID {
+		return
+	}
+	log.Debug().Str("message_id", msgID).Msg("Got result for queued outgoing message")
+	if sendErr != nil {
+		m.failOutgoing(ctx, entry, sendErr)
+	} else {
+		// The echo is in the same table, so it'll be handled normally
+		m.finishOutgoing(ctx, entry, nil)
+	}
+}
+
+// finishOutgoing removes a successfully sent message from the queue. The message itself is saved to the database
+// by the portal when the echo is received. If the send response included the message, it's queued as the echo,
+// in case the real echo doesn't come through the socket. Duplicate echoes are ignored by the portal.
+func (m *MetaClient) finishOutgoing(ctx context.Context, entry *metadb.OutgoingMessage, echo *table.WrappedMessage) {
+	if claimed, err := m.Main.DB.DeleteOutgoingMessage(ctx, entry.OTID); err != nil {
+		zerolog.Ctx(ctx).Err(err).Msg("Failed to remove message from send queue")
+		return
+	} else if !claimed {
+		return
+	}
+	if echo != nil {
+		m.Main.Bridge.QueueRemoteEvent(m.UserLogin, &FBMessageEvent{
+			WrappedMessage: echo,
+			portalKey:      entry.Portal,
+			m:              m,
+		})
+	}
+}
+
+func (m *MetaClient) failOutgoing(ctx context.Context, entry *metadb.OutgoingMessage, sendErr error) {
+	if claimed, err := m.Main.DB.DeleteOutgoingMessage(ctx, entry.OTID); err != nil {
+		zerolog.Ctx(ctx).Err(err).Msg("Failed to remove message from send queue")
+		return
+	} else if !claimed {
+		return
+	}
+	otidStr := strconv.FormatInt(entry.OTID, 10)
+	m.removePendingEcho(otidStr)
+	if evt, err := m.makeOutgoingEvent(ctx, entry); err == nil {
+		evt.RemovePending(networkid.TransactionID(otidStr))
+	}
+	msgStatus := bridgev2.WrapErrorInStatus(sendErr).WithStatus(event.MessageStatusFail)
+	if msgStatus.ErrorReason == "" {
+		msgStatus.ErrorReason = event.MessageStatusGenericError
+	}
+	m.Main.Bridge.Matrix.SendMessageStatus(ctx, &msgStatus, outgoingStatusEventInfo(entry))
+}
+
+func outgoingStatusEventInfo(entry *metadb.OutgoingMessage) *bridgev2.MessageStatusEventInfo {
+	return &bridgev2.MessageStatusEventInfo{
+		RoomID:    entry.RoomID,
+		EventID:   entry.EventID,
+		EventType: event.EventMessage,
+		Sender:    entry.SenderMXID,
+	}
+}
+
+func (m *MetaClient) sendPendingStatus(ctx context.Context, evt *event.Event) {
+	m.Main.Bridge.Matrix.SendMessageStatus(ctx, &bridgev2.MessageStatus{
+		Step:    status.MsgStepRemote,
+		Status:  event.MessageStatusPending,
+		Message: "Waiting for connection to Meta",
+	}, bridgev2.StatusEventInfoFromEvent(evt))
+}
@@ -2,15 +2,23 @@ package connector
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/bridgev2"
 	"maunium.net/go/mautrix/bridgev2/networkid"
 
+	"go.mau.fi/mautrix-meta/pkg/messagix"
 	"go.mau.fi/mautrix-meta/pkg/messagix/socket"
 	"go.mau.fi/mautrix-meta/pkg/messagix/table"
+	"go.mau.fi/mautrix-meta/pkg/messagix/types"
 	"go.mau.fi/mautrix-meta/pkg/metaid"
 )
 
@@ -33,9 +41,9 @@ func (m *MetaClient) ResolveIdentifier(ctx context.Context, identifier string, c
 	}
 	log := zerolog.Ctx(ctx)
 
-	id, err := metaid.ParseIDFromString(identifier)
+	id, userInfo, err := m.resolveIdentifierToFBID(ctx, identifier)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse identifier: %w", err)
+		return nil, err
 	}
 
 	var chat *bridgev2.CreateChatResponse
@@ -58,11 +66,117 @@ func (m *MetaClient) ResolveIdentifier(ctx context.Context, identifier string, c
 		}
 	}
 	return &bridgev2.ResolveIdentifierResponse{
-		UserID: metaid.MakeUserID(id),
-		Chat:   chat,
+		UserID:   metaid.MakeUserID(id),
+		UserInfo: userInfo,
+		Chat:     chat,
 	}, nil
 }
 
+var usernamePattern = regexp.MustCompile(`^[a-zA-Z0-9._]+$`)
+
+var ErrUnsupportedIdentifier = bridgev2.WrapRespErr(errors.New("unsupported identifier"), mautrix.MInvalidParam)
+
+// parseIdentifier parses a numeric ID, an @username, or a profile link. If a username is returned instead of an ID,
+// the platform tells which network it belongs to, or Unset if it could be either.
+func parseIdentifier(identifier string) (id int64, username string, platform types.Platform, err error) {
+	identifier = strings.TrimSpace(identifier)
+	if id, err = strconv.ParseInt(identifier, 10, 64); err == nil {
+		return
+	}
+	err = nil
+	if !strings.Contains(identifier, "/") {
+		username = strings.TrimPrefix(identifier, "@")
+	} else {
+		if !strings.Contains(identifier, "://") {
+			identifier = "https://" + identifier
+		}
+		var parsed *url.URL
+		parsed, err = url.Parse(identifier)
+		if err != nil {
+			err = fmt.Errorf("%w: failed to parse URL: %w", ErrUnsupportedIdentifier, err)
+			return
+		}
+		host := strings.ToLower(parsed.Hostname())
+		for _, prefix := range []string{"www.", "m.", "mbasic.", "web."} {
+			host = strings.TrimPrefix(host, prefix)
+		}
+		pathParts := strings.Split(strings.Trim(parsed.Path, "/"), "/")
+		switch host {
+		case "instagram.com", "instagr.am", "ig.me":
+			platform = types.Instagram
+			if (pathParts[0] == "stories" || pathParts[0] == "m") && len(pathParts) > 1 {
+				pathParts = pathParts[1:]
+			}
+		case "facebook.com", "fb.com", "messenger.com", "m.me":
+			platform = types.Facebook
+			if pathParts[0] == "profile.php" {
+				id, err = strconv.ParseInt(parsed.Query().Get("id"), 10, 64)
+				if err != nil {
+					err = fmt.Errorf("%w: invalid profile ID", ErrUnsupportedIdentifier)
+				}
+				return
+			} else if pathParts[0] == "messages" && len(pathParts) > 1 {
+				pathParts = pathParts[1:]
+			}
+			if pathParts[0] == "t" && len(pathParts) > 1 {
+				pathParts = pathParts[1:]
+			}
+		default:
+			err = fmt.Errorf("%w: unsupported link domain %s", ErrUnsupportedIdentifier, host)
+			return
+		}
+		username = pathParts[0]
+		if id, err = strconv.ParseInt(username, 10, 64); err == nil {
+			username = ""
+			return
+		}
+		err = nil
+	}
+	if !usernamePattern.MatchString(username) {
+		err = fmt.Errorf("%w: %q is not a valid ID, username or profile link", ErrUnsupportedIdentifier, identifier)
+	}
+	return
+}
+
+// resolveIdentifierToFBID finds the FBID of the user referred to by the given identifier. Instagram usernames
+// are resolved using the web profile API, Facebook vanity names using the thread page redirect.
+func (m *MetaClient) resolveIdentifierToFBID(ctx context.Context, identifier string) (int64, *bridgev2.UserInfo, error) {
+	id, username, platform, err := parseIdentifier(identifier)
+	if err != nil {
+		return 0, nil, err
+	} else if id != 0 {
+		return id, nil, nil
+	}
+	isInstagram := m.LoginMeta.Platform == types.Instagram
+	if platform != types.Unset && platform.IsMessenger() == isInstagram {
+		return 0, nil, fmt.Errorf("%w: can't resolve %s links when logged into %s", ErrUnsupportedIdentifier, platform, m.LoginMeta.Platform)
+	}
+	log := zerolog.Ctx(ctx).With().Str("username", username).Logger()
+	if isInstagram {
+		profile, err := m.Client.Instagram.FetchProfile(username)
+		if err != nil {
+			log.Err(err).Msg("Failed to fetch Instagram profile")
+			return 0, nil, fmt.Errorf("failed to fetch profile of @%s: %w", username, err)
+		} else if profile.Data.User.Username == "" {
+			return 0, nil, bridgev2.WrapRespErr(fmt.Errorf("user @%s not found", username), mautrix.MNotFound)
+		} else if profile.GetFBID() == 0 {
+			log.Warn().Str("ig_user_id", profile.Data.User.ID).Msg("Instagram profile doesn't have a messaging ID")
+			return 0, nil, bridgev2.WrapRespErr(fmt.Errorf("@%s can't be messaged", username), mautrix.MNotFound)
+		}
+		log.Debug().Int64("fbid", profile.GetFBID()).Str("ig_user_id", profile.Data.User.ID).Msg("Resolved Instagram username")
+		return profile.GetFBID(), m.wrapUserInfo(profile), nil
+	}
+	id, err = m.Client.Facebook.ResolveVanity(username)
+	if errors.Is(err, messagix.ErrVanityNotFound) {
+		return 0, nil, bridgev2.WrapRespErr(fmt.Errorf("user %s not found", username), mautrix.MNotFound)
+	} else if err != nil {
+		log.Err(err).Msg("Failed to resolve Facebook vanity name")
+		return 0, nil, fmt.Errorf("failed to resolve %s: %w", username, err)
+	}
+	log.Debug().Int64("fbid", id).Msg("Resolved Facebook vanity name")
+	return id, nil, nil
+}
+
 func (m *MetaClient) SearchUsers(ctx context.Context, search string) ([]*bridgev2.ResolveIdentifierResponse, error) {
 	if m.LoginMeta.Cookies == nil {
 		return nil, bridgev2.ErrNotLoggedIn
@@ -71,6 +185,19 @@ func (m *MetaClient) SearchUsers(ctx context.Context, search string) ([]*bridgev
 	}
 	log := zerolog.Ctx(ctx)
 
+	// Usernames and links can't be found with the normal search, so resolve them directly
+	if strings.HasPrefix(search, "@") || strings.Contains(search, "/") {
+		id, userInfo, err := m.resolveIdentifierToFBID(ctx, search)
+		if err == nil {
+			return []*bridgev2.ResolveIdentifierResponse{{
+				UserID:   metaid.MakeUserID(id),
+				UserInfo: userInfo,
+			}}, nil
+		}
+		log.Debug().Err(err).Msg("Failed to resolve search query as identifier, falling back to normal search")
+		search = strings.TrimPrefix(search, "@")
+	}
+
 	task := &socket.SearchUserTask{
 		Query: search,
 		SupportedTypes: []table.SearchType{
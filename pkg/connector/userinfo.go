@@ -5,18 +5,48 @@ import (
 	"fmt"
 	"net/url"
 	"path"
+	"time"
 
+	"github.com/rs/zerolog"
 	"go.mau.fi/util/ptr"
 	"maunium.net/go/mautrix/bridgev2"
 	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/event"
 
+	"go.mau.fi/mautrix-meta/pkg/messagix/data/responses"
+	"go.mau.fi/mautrix-meta/pkg/messagix/table"
 	"go.mau.fi/mautrix-meta/pkg/messagix/types"
 	"go.mau.fi/mautrix-meta/pkg/metaid"
 	"go.mau.fi/mautrix-meta/pkg/msgconv"
 )
 
+const profileRefreshInterval = 24 * time.Hour
+
+var followStatusEventType = event.Type{Type: "fi.mau.meta.follow_status", Class: event.StateEventType}
+
+// ghostProfileExtra contains the profile details that are set as extra profile fields on ghosts.
+type ghostProfileExtra struct {
+	Verified   bool   `json:"fi.mau.meta.verified"`
+	Biography  string `json:"fi.mau.meta.biography"`
+	IsBusiness bool   `json:"fi.mau.meta.is_business"`
+}
+
 func (m *MetaClient) GetUserInfo(ctx context.Context, ghost *bridgev2.Ghost) (*bridgev2.UserInfo, error) {
-	return nil, fmt.Errorf("getting user info is not supported")
+	if m.LoginMeta.Platform != types.Instagram || m.Client == nil {
+		return nil, nil
+	}
+	meta := ghost.Metadata.(*metaid.GhostMetadata)
+	if meta.Username == "" || time.Since(time.UnixMilli(meta.ProfileFetchedAt)) < profileRefreshInterval {
+		return nil, nil
+	}
+	profile, err := m.Client.Instagram.FetchProfile(meta.Username)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch profile of @%s: %w", meta.Username, err)
+	} else if profile.GetFBID() != metaid.ParseUserID(ghost.ID) {
+		// The username was taken over by someone else
+		return nil, nil
+	}
+	return m.wrapUserInfo(profile), nil
 }
 
 func (m *MetaClient) wrapUserInfo(info types.UserInfo) *bridgev2.UserInfo {
@@ -25,6 +55,12 @@ func (m *MetaClient) wrapUserInfo(info types.UserInfo) *bridgev2.UserInfo {
 		identifiers = append(identifiers, fmt.Sprintf("instagram:%s", info.GetUsername()))
 	}
 
+	var isBot *bool
+	profile, isProfile := info.(*responses.ProfileInfoResponse)
+	if isProfile {
+		isBot = ptr.Ptr(profile.Data.User.AiAgentType != nil)
+	}
+
 	return &bridgev2.UserInfo{
 		Identifiers: identifiers,
 		Name: ptr.Ptr(m.Main.Config.FormatDisplayname(DisplaynameParams{
@@ -33,18 +69,145 @@ func (m *MetaClient) wrapUserInfo(info types.UserInfo) *bridgev2.UserInfo {
 			ID:          info.GetFBID(),
 		})),
 		Avatar: wrapAvatar(info.GetAvatarURL()),
-		IsBot:  nil, // TODO
+		IsBot:  isBot,
 		ExtraUpdates: func(ctx context.Context, ghost *bridgev2.Ghost) (changed bool) {
 			meta := ghost.Metadata.(*metaid.GhostMetadata)
 			if m.LoginMeta.Platform == types.Instagram && meta.Username != info.GetUsername() {
 				meta.Username = info.GetUsername()
 				changed = true
 			}
+			if isProfile {
+				changed = updateGhostProfile(ctx, ghost, profile) || changed
+				m.updateFollowStatus(ctx, info.GetFBID(), func(status *metaid.FollowStatus) {
+					status.Following = profile.Data.User.FollowedByViewer
+					status.FollowedBy = profile.Data.User.FollowsViewer
+				})
+			}
 			return
 		},
 	}
 }
 
+func updateGhostProfile(ctx context.Context, ghost *bridgev2.Ghost, profile *responses.ProfileInfoResponse) bool {
+	user := &profile.Data.User
+	updateGhostProfileExtra(ctx, ghost, func(meta *metaid.GhostMetadata) {
+		meta.Verified = user.IsVerified
+		meta.Biography = user.Biography
+		meta.IsBusiness = user.IsBusinessAccount
+	})
+	// The fetch timestamp always changes, so the ghost always needs to be saved
+	ghost.Metadata.(*metaid.GhostMetadata).ProfileFetchedAt = time.Now().UnixMilli()
+	return true
+}
+
+// updateGhostProfileExtra applies the given changes to the ghost metadata,
+// and updates the extra profile fields on Matrix if anything changed.
+func updateGhostProfileExtra(ctx context.Context, ghost *bridgev2.Ghost, update func(meta *metaid.GhostMetadata)) bool {
+	meta := ghost.Metadata.(*metaid.GhostMetadata)
+	oldExtra := ghostProfileExtra{Verified: meta.Verified, Biography: meta.Biography, IsBusiness: meta.IsBusiness}
+	update(meta)
+	newExtra := ghostProfileExtra{Verified: meta.Verified, Biography: meta.Biography, IsBusiness: meta.IsBusiness}
+	if oldExtra == newExtra {
+		return false
+	}
+	err := ghost.Intent.SetExtraProfileMeta(ctx, &newExtra)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Str("ghost_id", string(ghost.ID)).Msg("Failed to set extra profile fields")
+	}
+	return true
+}
+
+// syncIGContactInfo stores the Instagram-specific details of a contact, which are sent separately from the contact itself.
+func (m *MetaClient) syncIGContactInfo(ctx context.Context, info *table.LSDeleteThenInsertIGContactInfo) {
+	// Verification status is an enum of different badge types, anything non-zero is some kind of verified
+	verified := info.VerificationStatus != 0
+	ghost := m.updateGhostExtra(ctx, info.ContactId, nil, func(meta *metaid.GhostMetadata) {
+		meta.Verified = verified
+	})
+	hasDM := m.updateFollowStatus(ctx, info.ContactId, func(status *metaid.FollowStatus) {
+		status.IGFollowStatus = info.IgFollowStatus
+	})
+	// Contact info doesn't include the bio, so fetch the full profile of users who the login has chats with
+	if hasDM && ghost != nil {
+		go m.refreshGhostProfile(ctx, ghost)
+	}
+}
+
+func (m *MetaClient) refreshGhostProfile(ctx context.Context, ghost *bridgev2.Ghost) {
+	if _, alreadyFetching := m.pendingProfileFetches.LoadOrStore(ghost.ID, struct{}{}); alreadyFetching {
+		return
+	}
+	defer m.pendingProfileFetches.Delete(ghost.ID)
+	info, err := m.GetUserInfo(ctx, ghost)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Str("ghost_id", string(ghost.ID)).Msg("Failed to refresh Instagram profile")
+	} else if info != nil {
+		ghost.UpdateInfo(ctx, info)
+	}
+}
+
+func (m *MetaClient) syncBotProfile(ctx context.Context, info *table.LSDeleteThenInsertBotProfileInfoV2) {
+	description := info.Description
+	if description == "" {
+		description = info.ShortDescription
+	}
+	m.updateGhostExtra(ctx, info.BotID, ptr.Ptr(true), func(meta *metaid.GhostMetadata) {
+		meta.Biography = description
+	})
+}
+
+func (m *MetaClient) updateGhostExtra(ctx context.Context, userID int64, isBot *bool, update func(meta *metaid.GhostMetadata)) *bridgev2.Ghost {
+	ghost, err := m.Main.Bridge.GetGhostByID(ctx, metaid.MakeUserID(userID))
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Int64("ghost_id", userID).Msg("Failed to get ghost")
+		return nil
+	}
+	ghost.UpdateInfo(ctx, &bridgev2.UserInfo{
+		IsBot: isBot,
+		ExtraUpdates: func(ctx context.Context, ghost *bridgev2.Ghost) bool {
+			return updateGhostProfileExtra(ctx, ghost, update)
+		},
+	})
+	return ghost
+}
+
+// updateFollowStatus updates the follow relationship stored in the DM portal with the given user,
+// and sends it to the room as a state event if it changed. The returned bool is false if there's no DM portal.
+func (m *MetaClient) updateFollowStatus(ctx context.Context, userID int64, update func(status *metaid.FollowStatus)) bool {
+	if m.LoginMeta.Platform != types.Instagram {
+		return false
+	}
+	log := zerolog.Ctx(ctx).With().Int64("user_id", userID).Logger()
+	portal, err := m.Main.Bridge.GetExistingPortalByKey(ctx, m.makeFBPortalKey(userID, table.ONE_TO_ONE))
+	if err != nil {
+		log.Err(err).Msg("Failed to get DM portal to update follow status")
+		return false
+	} else if portal == nil {
+		return false
+	}
+	meta := portal.Metadata.(*metaid.PortalMetadata)
+	var status metaid.FollowStatus
+	if meta.FollowStatus != nil {
+		status = *meta.FollowStatus
+	}
+	update(&status)
+	if meta.FollowStatus != nil && *meta.FollowStatus == status {
+		return true
+	}
+	meta.FollowStatus = &status
+	err = portal.Save(ctx)
+	if err != nil {
+		log.Err(err).Msg("Failed to save follow status")
+	}
+	if portal.MXID != "" {
+		_, err = m.Main.Bridge.Bot.SendState(ctx, portal.MXID, followStatusEventType, "", &event.Content{Parsed: &status}, time.Time{})
+		if err != nil {
+			log.Err(err).Msg("Failed to send follow status to room")
+		}
+	}
+	return true
+}
+
 func wrapAvatar(avatarURL string) *bridgev2.Avatar {
 	if avatarURL == "" {
 		return &bridgev2.Avatar{Remove: true}
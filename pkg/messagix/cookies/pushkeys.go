@@ -1,9 +1,19 @@
 package cookies
 
 import (
+	"crypto/aes"
+	"crypto/cipher"
 	"crypto/ecdh"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+
+	"golang.org/x/crypto/hkdf"
 )
 
 type PushKeysPublic struct {
@@ -12,8 +22,8 @@ type PushKeysPublic struct {
 }
 
 type PushKeys struct {
-	Public  PushKeysPublic
-	Private string
+	Public  PushKeysPublic `json:"public"`
+	Private string         `json:"private"`
 }
 
 func generatePushKeys() (*PushKeys, error) {
@@ -45,3 +55,100 @@ func generatePushKeys() (*PushKeys, error) {
 	}
 	return pushKeys, nil
 }
+
+var ErrInvalidPushPayload = errors.New("invalid push payload")
+
+const pushHeaderLength = 16 + 4 + 1
+
+func hkdfExpand(secret, salt, info []byte, length int) ([]byte, error) {
+	out := make([]byte, length)
+	_, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, info), out)
+	return out, err
+}
+
+// DecryptPush decrypts a web push message body that uses the aes128gcm content encoding (RFC 8291 and RFC 8188).
+func (pk *PushKeys) DecryptPush(body []byte) ([]byte, error) {
+	if len(body) < pushHeaderLength {
+		return nil, fmt.Errorf("%w: body too short", ErrInvalidPushPayload)
+	}
+	salt := body[:16]
+	recordSize := int(binary.BigEndian.Uint32(body[16:20]))
+	keyIDLength := int(body[20])
+	if recordSize <= 17 || len(body) < pushHeaderLength+keyIDLength {
+		return nil, fmt.Errorf("%w: invalid header", ErrInvalidPushPayload)
+	}
+	senderKeyBytes := body[pushHeaderLength : pushHeaderLength+keyIDLength]
+	ciphertext := body[pushHeaderLength+keyIDLength:]
+
+	privateKeyBytes, err := base64.URLEncoding.DecodeString(pk.Private)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode private key: %w", err)
+	}
+	authSecret, err := base64.URLEncoding.DecodeString(pk.Public.Auth)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode auth secret: %w", err)
+	}
+	curve := ecdh.P256()
+	privateKey, err := curve.NewPrivateKey(privateKeyBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key: %w", err)
+	}
+	senderKey, err := curve.NewPublicKey(senderKeyBytes)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid sender key: %w", ErrInvalidPushPayload, err)
+	}
+	sharedSecret, err := privateKey.ECDH(senderKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute shared secret: %w", err)
+	}
+
+	keyInfo := slices.Concat([]byte("WebPush: info\x00"), privateKey.PublicKey().Bytes(), senderKey.Bytes())
+	ikm, err := hkdfExpand(sharedSecret, authSecret, keyInfo, 32)
+	if err != nil {
+		return nil, err
+	}
+	contentKey, err := hkdfExpand(ikm, salt, []byte("Content-Encoding: aes128gcm\x00"), 16)
+	if err != nil {
+		return nil, err
+	}
+	baseNonce, err := hkdfExpand(ikm, salt, []byte("Content-Encoding: nonce\x00"), 12)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(contentKey)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	var plaintext []byte
+	for seq := uint64(0); len(ciphertext) > 0; seq++ {
+		record := ciphertext[:min(len(ciphertext), recordSize)]
+		ciphertext = ciphertext[len(record):]
+		nonce := slices.Clone(baseNonce)
+		for i := 0; i < 8; i++ {
+			nonce[len(nonce)-1-i] ^= byte(seq >> (8 * i))
+		}
+		decrypted, err := gcm.Open(nil, nonce, record, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt record #%d: %w", seq, err)
+		}
+		// Records end with a delimiter byte (2 for the last record, 1 for others) followed by zero padding
+		end := len(decrypted) - 1
+		for end >= 0 && decrypted[end] == 0 {
+			end--
+		}
+		expectedDelimiter := byte(1)
+		if len(ciphertext) == 0 {
+			expectedDelimiter = 2
+		}
+		if end < 0 || decrypted[end] != expectedDelimiter {
+			return nil, fmt.Errorf("%w: invalid padding in record #%d", ErrInvalidPushPayload, seq)
+		}
+		plaintext = append(plaintext, decrypted[:end]...)
+	}
+	return plaintext, nil
+}
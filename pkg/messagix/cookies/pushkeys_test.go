@@ -0,0 +1,68 @@
+package cookies
+
+import (
+	"encoding/base64"
+	"errors"
+	"testing"
+)
+
+// Test vector from RFC 8291 appendix A
+const (
+	rfc8291Plaintext  = "When I grow up, I want to be a watermelon"
+	rfc8291UAPublic   = "BCVxsr7N_eNgVRqvHtD0zTZsEc6-VV-JvLexhqUzORcxaOzi6-AYWXvTBHm4bjyPjs7Vd8pZGH6SRpkNtoIAiw4"
+	rfc8291UAPrivate  = "q1dXpw3UpT5VOmu_cf_v6ih07Aems3njxI-JWgLcM94"
+	rfc8291AuthSecret = "BTBZMqHH6r4Tts7J_aSIgg"
+	rfc8291Body       = "DGv6ra1nlYgDCS1FRnbzlwAAEABBBP4z9KsN6nGRTbVYI_c7VJSPQTBtkgcy27mlmlMoZIIgDll6e3vCYLocInmYWAmS6TlzAC8wEqKK6PBru3jl7A_yl95bQpu6cVPTpK4Mqgkf1CXztLVBSt2Ks3oZwbuwXPXLWyouBWLVWGNWQexSgSxsj_Qulcy4a-fN"
+)
+
+func rawToPadded(t *testing.T, raw string) string {
+	t.Helper()
+	data, err := base64.RawURLEncoding.DecodeString(raw)
+	if err != nil {
+		t.Fatalf("failed to decode %q: %v", raw, err)
+	}
+	return base64.URLEncoding.EncodeToString(data)
+}
+
+func rfc8291Keys(t *testing.T) *PushKeys {
+	return &PushKeys{
+		Public: PushKeysPublic{
+			P256dh: rawToPadded(t, rfc8291UAPublic),
+			Auth:   rawToPadded(t, rfc8291AuthSecret),
+		},
+		Private: rawToPadded(t, rfc8291UAPrivate),
+	}
+}
+
+func rfc8291BodyBytes(t *testing.T) []byte {
+	body, err := base64.RawURLEncoding.DecodeString(rfc8291Body)
+	if err != nil {
+		t.Fatalf("failed to decode body: %v", err)
+	}
+	return body
+}
+
+func TestDecryptPush(t *testing.T) {
+	plaintext, err := rfc8291Keys(t).DecryptPush(rfc8291BodyBytes(t))
+	if err != nil {
+		t.Fatalf("failed to decrypt: %v", err)
+	} else if string(plaintext) != rfc8291Plaintext {
+		t.Fatalf("unexpected plaintext %q", plaintext)
+	}
+}
+
+func TestDecryptPush_Tampered(t *testing.T) {
+	body := rfc8291BodyBytes(t)
+	body[len(body)-1] ^= 0xff
+	_, err := rfc8291Keys(t).DecryptPush(body)
+	if err == nil {
+		t.Fatal("expected error for tampered body")
+	}
+}
+
+func TestDecryptPush_TooShort(t *testing.T) {
+	_, err := rfc8291Keys(t).DecryptPush(make([]byte, 10))
+	if !errors.Is(err, ErrInvalidPushPayload) {
+		t.Fatalf("expected ErrInvalidPushPayload, got %v", err)
+	}
+}
@@ -1,5 +1,9 @@
 package responses
 
+import (
+	"strconv"
+)
+
 type ProfileInfoResponse struct {
 	Data struct {
 		User struct {
@@ -104,6 +108,27 @@ type ProfileInfoResponse struct {
 	Status string `json:"status"`
 }
 
+func (pir *ProfileInfoResponse) GetUsername() string {
+	return pir.Data.User.Username
+}
+
+func (pir *ProfileInfoResponse) GetName() string {
+	return pir.Data.User.FullName
+}
+
+func (pir *ProfileInfoResponse) GetAvatarURL() string {
+	if pir.Data.User.ProfilePicURLHd != "" {
+		return pir.Data.User.ProfilePicURLHd
+	}
+	return pir.Data.User.ProfilePicURL
+}
+
+// GetFBID returns the messaging ID of the user, which is different from the Instagram user ID.
+func (pir *ProfileInfoResponse) GetFBID() int64 {
+	fbid, _ := strconv.ParseInt(pir.Data.User.EimuID, 10, 64)
+	return fbid
+}
+
 type EdgeOwnerToTimelineMedia struct {
 	Count int `json:"count"`
 	Edges []struct {
@@ -4,7 +4,9 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net/url"
 	"reflect"
+	"regexp"
 	"strconv"
 	"strings"
 
@@ -76,6 +78,37 @@ func (fb *FacebookMethods) Login(identifier, password string) (*cookies.Cookies,
 	return fb.client.cookies, nil
 }
 
+var (
+	threadURLPathPattern = regexp.MustCompile(`^/(?:messages/)?t/(\d+)/?$`)
+	profileIDPattern     = regexp.MustCompile(`fb://profile/(\d+)`)
+)
+
+var ErrVanityNotFound = errors.New("vanity name not found")
+
+// ResolveVanity finds the ID of the user with the given vanity name (the username in facebook.com/<vanity> links).
+func (fb *FacebookMethods) ResolveVanity(vanity string) (int64, error) {
+	headers := fb.client.buildHeaders(true)
+	headers.Set("accept", "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8")
+	headers.Set("sec-fetch-dest", "document")
+	headers.Set("sec-fetch-mode", "navigate")
+	reqURL := fb.client.getEndpoint("thread") + url.PathEscape(vanity) + "/"
+	resp, body, err := fb.client.MakeRequest(reqURL, "GET", headers, nil, types.NONE)
+	if err != nil {
+		return 0, fmt.Errorf("failed to fetch thread page for %s: %w", vanity, err)
+	} else if resp.StatusCode == 404 {
+		return 0, ErrVanityNotFound
+	} else if resp.StatusCode >= 300 || resp.StatusCode < 200 {
+		return 0, fmt.Errorf("bad status code: %d", resp.StatusCode)
+	}
+	// Thread links using vanity names are redirected to the numeric ID
+	if match := threadURLPathPattern.FindStringSubmatch(resp.Request.URL.Path); match != nil {
+		return strconv.ParseInt(match[1], 10, 64)
+	} else if match = profileIDPattern.FindStringSubmatch(string(body)); match != nil {
+		return strconv.ParseInt(match[1], 10, 64)
+	}
+	return 0, ErrVanityNotFound
+}
+
 func (fb *FacebookMethods) RegisterPushNotifications(endpoint string) error {
 	c := fb.client
 	jsonKeys, err := json.Marshal(c.cookies.PushKeys.Public)
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net/url"
 	"strconv"
+	"strings"
 
 	"github.com/google/go-querystring/query"
 	"github.com/google/uuid"
@@ -265,3 +266,32 @@ func (ig *InstagramMethods) ExtractFBID(currentUser types.UserInfo, tbl *table.L
 
 	return newFBID, nil
 }
+
+const shortcodeAlphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_"
+
+// shortcodeMaxLength is the maximum number of characters in a shortcode that encodes a media ID.
+// Longer shortcodes (e.g. of private posts) can't be converted.
+const shortcodeMaxLength = 11
+
+// ShortcodeToMediaID converts a post shortcode (e.g. from an instagram.com/p/... link) into a media ID.
+func ShortcodeToMediaID(shortcode string) (string, error) {
+	if len(shortcode) == 0 {
+		return "", fmt.Errorf("empty shortcode")
+	} else if len(shortcode) > shortcodeMaxLength {
+		return "", fmt.Errorf("shortcode too long (%d > %d characters)", len(shortcode), shortcodeMaxLength)
+	}
+	var mediaID uint64
+	for _, char := range shortcode {
+		idx := strings.IndexRune(shortcodeAlphabet, char)
+		if idx < 0 {
+			return "", fmt.Errorf("invalid character %q in shortcode", char)
+		} else if mediaID>>58 != 0 {
+			return "", fmt.Errorf("shortcode %q overflows media ID", shortcode)
+		}
+		mediaID = mediaID<<6 | uint64(idx)
+	}
+	if mediaID == 0 {
+		return "", fmt.Errorf("shortcode %q encodes zero media ID", shortcode)
+	}
+	return strconv.FormatUint(mediaID, 10), nil
+}
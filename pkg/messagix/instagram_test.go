@@ -0,0 +1,57 @@
+package messagix
+
+import (
+	"testing"
+)
+
+func TestShortcodeToMediaID(t *testing.T) {
+	cases := []struct {
+		shortcode string
+		mediaID   string
+	}{
+		// Widely documented pair (media ID 908540701891980503_1639186)
+		{"ybyPRoQWzX", "908540701891980503"},
+		{"B", "1"},
+		{"BA", "64"},
+		{"_", "63"},
+		{"-_", "4031"},
+	}
+	for _, c := range cases {
+		mediaID, err := ShortcodeToMediaID(c.shortcode)
+		if err != nil {
+			t.Errorf("unexpected error for %q: %v", c.shortcode, err)
+		} else if mediaID != c.mediaID {
+			t.Errorf("expected %s for %q, got %s", c.mediaID, c.shortcode, mediaID)
+		}
+	}
+}
+
+func TestShortcodeToMediaID_Max(t *testing.T) {
+	// 11 characters starting with a character below index 16 fill exactly 64 bits
+	mediaID, err := ShortcodeToMediaID("P__________")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else if mediaID != "18446744073709551615" {
+		t.Fatalf("expected max uint64, got %s", mediaID)
+	}
+}
+
+func TestShortcodeToMediaID_Invalid(t *testing.T) {
+	for _, shortcode := range []string{
+		"",
+		"A",
+		"abc$def",
+		"ab cd",
+		"ybyPRoQWzX\u00e9",
+		// Overflows uint64
+		"Q__________",
+		"___________",
+		// Longer than a media ID shortcode, e.g. private post links
+		"CzXwLnpOhFaZk3yTb0qQ1xPmNdEe7f-Rr9_vW",
+		"AAAAAAAAAAAB",
+	} {
+		if mediaID, err := ShortcodeToMediaID(shortcode); err == nil {
+			t.Errorf("expected error for %q, got %s", shortcode, mediaID)
+		}
+	}
+}
@@ -18,6 +18,7 @@ import (
 
 	"go.mau.fi/mautrix-meta/pkg/messagix/methods"
 	"go.mau.fi/mautrix-meta/pkg/messagix/packets"
+	"go.mau.fi/mautrix-meta/pkg/messagix/table"
 	"go.mau.fi/mautrix-meta/pkg/messagix/types"
 )
 
@@ -414,6 +415,55 @@ func (s *Socket) makeLSRequest(payload []byte, t int) (*Event_PublishResponse, e
 	return s.responseHandler.waitForPubResponseDetails(packetId)
 }
 
+type SocketTypingPayload struct {
+	Label   string `json:"label"`
+	Payload string `json:"payload"`
+	Version string `json:"version"`
+}
+
+type TypingIndicatorPayload struct {
+	ThreadKey     int64            `json:"thread_key"`
+	IsGroupThread int              `json:"is_group_thread"`
+	IsTyping      int              `json:"is_typing"`
+	Attribution   int              `json:"attribution"`
+	SyncGroup     int              `json:"sync_group"`
+	ThreadType    table.ThreadType `json:"thread_type"`
+}
+
+// sendTypingIndicator publishes a typing notification on the ls_req topic.
+// Unlike normal LS requests, the server doesn't send a response for these.
+func (s *Socket) sendTypingIndicator(payload *TypingIndicatorPayload) error {
+	innerPayload, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	typingPayload, err := json.Marshal(&SocketTypingPayload{
+		Label:   "3",
+		Payload: string(innerPayload),
+		Version: strconv.FormatInt(s.client.configs.VersionId, 10),
+	})
+	if err != nil {
+		return err
+	}
+	packetId := s.SafePacketId()
+	lsPayload := &SocketLSRequestPayload{
+		AppId:     s.client.configs.browserConfigTable.CurrentUserInitialData.AppID,
+		Payload:   string(typingPayload),
+		RequestId: int(packetId),
+		Type:      4,
+	}
+	jsonPayload, err := json.Marshal(lsPayload)
+	if err != nil {
+		return err
+	}
+	_, err = s.sendPublishPacket(LS_REQ, string(jsonPayload), &packets.PublishPacket{QOSLevel: packets.QOS_LEVEL_1}, packetId)
+	if err != nil {
+		return err
+	}
+	s.responseHandler.deleteDetails(packetId, RequestChannel)
+	return nil
+}
+
 func (s *Socket) getConnHeaders() http.Header {
 	h := http.Header{}
 
@@ -1,5 +1,9 @@
 package socket
 
+import (
+	"encoding/json"
+)
+
 /*
 	type 3 = task
 */
@@ -51,3 +55,44 @@ type TaskData struct {
 	QueueName    interface{} `json:"queue_name,omitempty"`
 	TaskId       int64       `json:"task_id"`
 }
+
+// RawTask is a task whose payload and queue name have already been serialized.
+// It can be used to store tasks and execute them again later with the exact same payload.
+type RawTask struct {
+	Label     string          `json:"label"`
+	Payload   json.RawMessage `json:"payload"`
+	QueueName json.RawMessage `json:"queue_name"`
+}
+
+// NewRawTask serializes the given task the same way the task manager does.
+func NewRawTask(task Task) (*RawTask, error) {
+	payload, queueName, marshalQueueName := task.Create()
+	payloadMarshalled, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	if marshalQueueName {
+		queueNameMarshalled, err := json.Marshal(queueName)
+		if err != nil {
+			return nil, err
+		}
+		queueName = string(queueNameMarshalled)
+	}
+	queueNameMarshalled, err := json.Marshal(queueName)
+	if err != nil {
+		return nil, err
+	}
+	return &RawTask{
+		Label:     task.GetLabel(),
+		Payload:   payloadMarshalled,
+		QueueName: queueNameMarshalled,
+	}, nil
+}
+
+func (t *RawTask) GetLabel() string {
+	return t.Label
+}
+
+func (t *RawTask) Create() (any, any, bool) {
+	return t.Payload, t.QueueName, false
+}
@@ -42,6 +42,8 @@ type ReplyMetaData struct {
 	ReplySourceType int64  `json:"reply_source_type"` // 1 ?
 	ReplyType       int64  `json:"reply_type"`        // ?
 	ReplySender     int64  `json:"-"`
+	// StoryOwner is the author of the story for story replies. It's not sent for normal replies.
+	StoryOwner int64 `json:"reply_sender_id,omitempty"`
 }
 
 type MentionData struct {
@@ -254,8 +256,9 @@ func (t *SetThreadImageTask) Create() (interface{}, interface{}, bool) {
 }
 
 type EditMessageTask struct {
-	MessageID string `json:"message_id"`
-	Text      string `json:"text"`
+	MessageID   string       `json:"message_id"`
+	Text        string       `json:"text"`
+	MentionData *MentionData `json:"mention_data,omitempty"`
 }
 
 func (t *EditMessageTask) GetLabel() string {
@@ -171,6 +171,10 @@ type LSInsertCommunityMember struct {
 	Unrecognized map[int]any `json:",omitempty"`
 }
 
+func (ls *LSInsertCommunityMember) GetThreadKey() int64 {
+	return ls.CommunityID
+}
+
 type LSUpdateOrInsertCommunityMember struct {
 	CommunityID                            int64  `index:"0" json:",omitempty"`
 	ContactID                              int64  `index:"1" json:",omitempty"`
@@ -195,6 +199,10 @@ type LSUpdateOrInsertCommunityMember struct {
 	Unrecognized map[int]any `json:",omitempty"`
 }
 
+func (ls *LSUpdateOrInsertCommunityMember) GetThreadKey() int64 {
+	return ls.CommunityID
+}
+
 type LSUpsertCommunityMemberRanges struct {
 	CommunityID int64 `index:"0" json:",omitempty"`
 	//IsAdmin    int64  `index:"1" json:",omitempty"`
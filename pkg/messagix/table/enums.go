@@ -147,6 +147,10 @@ const (
 	AttachmentTypeThirdPartySticker
 )
 
+func (at AttachmentType) IsEphemeral() bool {
+	return at == AttachmentTypeEphemeralImage || at == AttachmentTypeEphemeralVideo
+}
+
 type SendType int64
 
 const (
@@ -250,6 +254,15 @@ func (tt ThreadType) IsWhatsApp() bool {
 	}
 }
 
+func (tt ThreadType) IsCommunitySpace() bool {
+	switch tt {
+	case COMMUNITY_FOLDER, COMMUNITY_CHANNEL_CATEGORY:
+		return true
+	default:
+		return false
+	}
+}
+
 const (
 	UNKNOWN_THREAD_TYPE                         ThreadType = 0
 	ONE_TO_ONE                                  ThreadType = 1
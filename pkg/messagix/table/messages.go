@@ -599,3 +599,13 @@ type LSSetNumUnreadSubthreads struct {
 	ThreadKey int64 `index:"0" json:",omitempty"`
 	NumUnread int64 `index:"1" json:",omitempty"`
 }
+
+// LSUpdateThreadTQSeqID contains the latest thread queue sequence ID of a community thread.
+// A jump of more than one means that deltas were missed and hole detection should be used.
+type LSUpdateThreadTQSeqID struct {
+	ThreadKey int64 `index:"0" json:",omitempty"`
+	TQSeqID   int64 `index:"1" json:",omitempty"`
+	DeltaType int64 `index:"2" json:",omitempty"` /* not sure */
+
+	Unrecognized map[int]any `json:",omitempty"`
+}
@@ -153,6 +153,7 @@ type LSTable struct {
 	LSUpsertCommunityMemberRanges                    []*LSUpsertCommunityMemberRanges                    `json:",omitempty"`
 	LSUpdateSubThreadXMA                             []*LSUpdateSubThreadXMA                             `json:",omitempty"`
 	LSSetNumUnreadSubthreads                         []*LSSetNumUnreadSubthreads                         `json:",omitempty"`
+	LSUpdateThreadTQSeqID                            []*LSUpdateThreadTQSeqID                            `json:",omitempty"`
 }
 
 // TODO replace SPTable with struct tags
@@ -298,6 +299,7 @@ var SPTable = map[string]string{
 	"upsertCommunityMemberRanges":                    "LSUpsertCommunityMemberRanges",
 	"updateSubThreadXMA":                             "LSUpdateSubThreadXMA",
 	"setNumUnreadSubthreads":                         "LSSetNumUnreadSubthreads",
+	"updateThreadTqSeqId":                            "LSUpdateThreadTQSeqID",
 }
 
 func SPToDepMap(sp []string) map[string]string {
@@ -604,6 +604,10 @@ type LSSetThreadCannotUnsendReason struct {
 	Unrecognized map[int]any `json:",omitempty"`
 }
 
+func (ls *LSSetThreadCannotUnsendReason) GetThreadKey() int64 {
+	return ls.ThreadKey
+}
+
 type LSClearLocalThreadPictureUrl struct {
 	ThreadKey int64 `index:"0" json:",omitempty"`
 
@@ -28,3 +28,21 @@ func (c *Client) ExecuteTasks(tasks ...socket.Task) (*table.LSTable, error) {
 
 	return resp.Table, nil
 }
+
+func (c *Client) SetTyping(threadKey int64, threadType table.ThreadType, isTyping bool) error {
+	payload := &TypingIndicatorPayload{
+		ThreadKey:  threadKey,
+		SyncGroup:  1,
+		ThreadType: threadType,
+	}
+	if !threadType.IsOneToOne() {
+		payload.IsGroupThread = 1
+	}
+	if threadType == table.COMMUNITY_GROUP {
+		payload.SyncGroup = 104
+	}
+	if isTyping {
+		payload.IsTyping = 1
+	}
+	return c.socket.sendTypingIndicator(payload)
+}
@@ -1,4 +1,4 @@
--- v0 -> v1 (compatible with v1+): Latest schema
+-- v0 -> v4 (compatible with v1+): Latest schema
 CREATE TABLE meta_thread (
     parent_key BIGINT NOT NULL,
     thread_key BIGINT NOT NULL,
@@ -7,3 +7,36 @@ CREATE TABLE meta_thread (
     PRIMARY KEY (thread_key),
     CONSTRAINT meta_thread_message_id_unique UNIQUE (message_id)
 );
+
+CREATE TABLE meta_reaction_v2 (
+    message_id    TEXT   NOT NULL,
+    reaction_fbid BIGINT NOT NULL,
+    reaction      TEXT   NOT NULL,
+    count         BIGINT NOT NULL,
+
+    PRIMARY KEY (message_id, reaction_fbid)
+);
+
+CREATE TABLE meta_edit_history (
+    message_id TEXT   NOT NULL,
+    edit_ts    BIGINT NOT NULL,
+    text       TEXT   NOT NULL,
+    stored_at  BIGINT NOT NULL,
+
+    PRIMARY KEY (message_id, edit_ts)
+);
+
+CREATE TABLE meta_outgoing_message (
+    otid            BIGINT  NOT NULL,
+    login_id        TEXT    NOT NULL,
+    portal_id       TEXT    NOT NULL,
+    portal_receiver TEXT    NOT NULL,
+    room_id         TEXT    NOT NULL,
+    event_id        TEXT    NOT NULL,
+    sender_mxid     TEXT    NOT NULL,
+    tasks           TEXT    NOT NULL,
+    attempts        INTEGER NOT NULL,
+    created_at      BIGINT  NOT NULL,
+
+    PRIMARY KEY (otid)
+);
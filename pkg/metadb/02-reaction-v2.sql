@@ -0,0 +1,9 @@
+-- v2 (compatible with v1+): Add table for community reaction summaries
+CREATE TABLE meta_reaction_v2 (
+    message_id    TEXT   NOT NULL,
+    reaction_fbid BIGINT NOT NULL,
+    reaction      TEXT   NOT NULL,
+    count         BIGINT NOT NULL,
+
+    PRIMARY KEY (message_id, reaction_fbid)
+);
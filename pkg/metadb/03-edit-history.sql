@@ -0,0 +1,9 @@
+-- v3 (compatible with v1+): Add table for message edit history
+CREATE TABLE meta_edit_history (
+    message_id TEXT   NOT NULL,
+    edit_ts    BIGINT NOT NULL,
+    text       TEXT   NOT NULL,
+    stored_at  BIGINT NOT NULL,
+
+    PRIMARY KEY (message_id, edit_ts)
+);
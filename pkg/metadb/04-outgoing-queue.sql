@@ -0,0 +1,15 @@
+-- v4 (compatible with v1+): Add table for outgoing message queue
+CREATE TABLE meta_outgoing_message (
+    otid            BIGINT  NOT NULL,
+    login_id        TEXT    NOT NULL,
+    portal_id       TEXT    NOT NULL,
+    portal_receiver TEXT    NOT NULL,
+    room_id         TEXT    NOT NULL,
+    event_id        TEXT    NOT NULL,
+    sender_mxid     TEXT    NOT NULL,
+    tasks           TEXT    NOT NULL,
+    attempts        INTEGER NOT NULL,
+    created_at      BIGINT  NOT NULL,
+
+    PRIMARY KEY (otid)
+);
@@ -20,10 +20,14 @@ import (
 	"context"
 	"database/sql"
 	"embed"
+	"encoding/json"
 	"errors"
+	"time"
 
 	"github.com/rs/zerolog"
 	"go.mau.fi/util/dbutil"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/id"
 )
 
 type MetaDB struct {
@@ -72,3 +76,149 @@ func (db *MetaDB) GetThreadByMessage(ctx context.Context, messageID string) (thr
 	}
 	return
 }
+
+func (db *MetaDB) DeleteThread(ctx context.Context, threadKey int64) error {
+	_, err := db.Exec(ctx, "DELETE FROM meta_thread WHERE thread_key = $1", threadKey)
+	return err
+}
+
+type ReactionV2 struct {
+	MessageID    string
+	ReactionFBID int64
+	Reaction     string
+	Count        int64
+}
+
+func (db *MetaDB) PutReactionV2(ctx context.Context, reaction *ReactionV2) error {
+	_, err := db.Exec(ctx, `
+		INSERT INTO meta_reaction_v2 (message_id, reaction_fbid, reaction, count)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (message_id, reaction_fbid) DO UPDATE
+			SET reaction=excluded.reaction, count=excluded.count
+	`, reaction.MessageID, reaction.ReactionFBID, reaction.Reaction, reaction.Count)
+	return err
+}
+
+func (db *MetaDB) DeleteReactionV2(ctx context.Context, messageID string, reactionFBID int64) error {
+	_, err := db.Exec(ctx, "DELETE FROM meta_reaction_v2 WHERE message_id = $1 AND reaction_fbid = $2", messageID, reactionFBID)
+	return err
+}
+
+func (db *MetaDB) GetReactionsV2(ctx context.Context, messageID string) ([]*ReactionV2, error) {
+	rows, err := db.Query(ctx, "SELECT message_id, reaction_fbid, reaction, count FROM meta_reaction_v2 WHERE message_id = $1", messageID)
+	return dbutil.NewRowIterWithError(rows, scanReactionV2, err).AsList()
+}
+
+func scanReactionV2(row dbutil.Scannable) (*ReactionV2, error) {
+	var reaction ReactionV2
+	err := row.Scan(&reaction.MessageID, &reaction.ReactionFBID, &reaction.Reaction, &reaction.Count)
+	return &reaction, err
+}
+
+type EditHistoryEntry struct {
+	MessageID     string
+	EditTimestamp int64
+	Text          string
+}
+
+func (db *MetaDB) PutEditHistory(ctx context.Context, entry *EditHistoryEntry) error {
+	_, err := db.Exec(ctx, `
+		INSERT INTO meta_edit_history (message_id, edit_ts, text, stored_at)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (message_id, edit_ts) DO UPDATE SET text=excluded.text, stored_at=excluded.stored_at
+	`, entry.MessageID, entry.EditTimestamp, entry.Text, time.Now().UnixMilli())
+	return err
+}
+
+func (db *MetaDB) GetEditHistory(ctx context.Context, messageID string) ([]*EditHistoryEntry, error) {
+	rows, err := db.Query(ctx, "SELECT message_id, edit_ts, text FROM meta_edit_history WHERE message_id = $1 ORDER BY edit_ts", messageID)
+	return dbutil.NewRowIterWithError(rows, scanEditHistoryEntry, err).AsList()
+}
+
+func (db *MetaDB) DeleteEditHistory(ctx context.Context, messageID string) error {
+	_, err := db.Exec(ctx, "DELETE FROM meta_edit_history WHERE message_id = $1", messageID)
+	return err
+}
+
+// DeleteExpiredEditHistory deletes edit history entries that were stored before the given time,
+// which happens when the edited message is never backfilled.
+func (db *MetaDB) DeleteExpiredEditHistory(ctx context.Context, before time.Time) error {
+	_, err := db.Exec(ctx, "DELETE FROM meta_edit_history WHERE stored_at < $1", before.UnixMilli())
+	return err
+}
+
+func scanEditHistoryEntry(row dbutil.Scannable) (*EditHistoryEntry, error) {
+	var entry EditHistoryEntry
+	err := row.Scan(&entry.MessageID, &entry.EditTimestamp, &entry.Text)
+	return &entry, err
+}
+
+type OutgoingMessage struct {
+	OTID       int64
+	LoginID    networkid.UserLoginID
+	Portal     networkid.PortalKey
+	RoomID     id.RoomID
+	EventID    id.EventID
+	SenderMXID id.UserID
+	Tasks      json.RawMessage
+	Attempts   int
+	CreatedAt  time.Time
+}
+
+const getOutgoingMessageBaseQuery = `
+	SELECT otid, login_id, portal_id, portal_receiver, room_id, event_id, sender_mxid, tasks, attempts, created_at
+	FROM meta_outgoing_message
+`
+
+func (db *MetaDB) PutOutgoingMessage(ctx context.Context, msg *OutgoingMessage) error {
+	_, err := db.Exec(ctx, `
+		INSERT INTO meta_outgoing_message (otid, login_id, portal_id, portal_receiver, room_id, event_id, sender_mxid, tasks, attempts, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+	`, msg.OTID, msg.LoginID, msg.Portal.ID, msg.Portal.Receiver, msg.RoomID, msg.EventID, msg.SenderMXID, string(msg.Tasks), msg.Attempts, msg.CreatedAt.UnixMilli())
+	return err
+}
+
+func (db *MetaDB) GetOutgoingMessage(ctx context.Context, otid int64) (*OutgoingMessage, error) {
+	msg, err := scanOutgoingMessage(db.QueryRow(ctx, getOutgoingMessageBaseQuery+"WHERE otid = $1", otid))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return msg, err
+}
+
+func (db *MetaDB) GetOutgoingMessages(ctx context.Context, loginID networkid.UserLoginID) ([]*OutgoingMessage, error) {
+	rows, err := db.Query(ctx, getOutgoingMessageBaseQuery+"WHERE login_id = $1 ORDER BY created_at", loginID)
+	return dbutil.NewRowIterWithError(rows, scanOutgoingMessage, err).AsList()
+}
+
+func (db *MetaDB) IncrementOutgoingMessageAttempts(ctx context.Context, otid int64) error {
+	_, err := db.Exec(ctx, "UPDATE meta_outgoing_message SET attempts = attempts + 1 WHERE otid = $1", otid)
+	return err
+}
+
+// DeleteOutgoingMessage removes a message from the outgoing queue.
+// The returned bool is true if the message was still in the queue, which can be used to ensure it's only finished once.
+func (db *MetaDB) DeleteOutgoingMessage(ctx context.Context, otid int64) (bool, error) {
+	res, err := db.Exec(ctx, "DELETE FROM meta_outgoing_message WHERE otid = $1", otid)
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	return affected > 0, err
+}
+
+func scanOutgoingMessage(row dbutil.Scannable) (*OutgoingMessage, error) {
+	var msg OutgoingMessage
+	var tasks string
+	var createdAt int64
+	err := row.Scan(
+		&msg.OTID, &msg.LoginID, &msg.Portal.ID, &msg.Portal.Receiver, &msg.RoomID, &msg.EventID, &msg.SenderMXID,
+		&tasks, &msg.Attempts, &createdAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	msg.Tasks = json.RawMessage(tasks)
+	msg.CreatedAt = time.UnixMilli(createdAt)
+	return &msg, nil
+}
@@ -5,6 +5,7 @@ import (
 
 	waTypes "go.mau.fi/whatsmeow/types"
 	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/id"
 
 	"go.mau.fi/mautrix-meta/pkg/messagix/cookies"
 	"go.mau.fi/mautrix-meta/pkg/messagix/table"
@@ -12,22 +13,79 @@ import (
 )
 
 type MessageMetadata struct {
-	EditTimestamp int64 `json:"edit_timestamp,omitempty"`
+	EditTimestamp      int64                            `json:"edit_timestamp,omitempty"`
+	CannotUnsendReason table.MessageUnsendabilityStatus `json:"cannot_unsend_reason,omitempty"`
+	// IsTextPart marks the part containing the text of a Messenger message, which is the part that edits replace.
+	IsTextPart bool             `json:"is_text_part,omitempty"`
+	Mentions   []MessageMention `json:"mentions,omitempty"`
+	// AttachmentFBID and MediaURI identify the media in attachment parts, which allows sending Matrix forwards of
+	// the media as native Meta forwards.
+	AttachmentFBID string              `json:"attachment_fbid,omitempty"`
+	MediaURI       id.ContentURIString `json:"media_uri,omitempty"`
+	// StoryReply is set on messages that replied or reacted to a story,
+	// so that Matrix replies to them can be sent as replies to the same story.
+	StoryReply *StoryReference `json:"story_reply,omitempty"`
+}
+
+// StoryReference identifies the story that a message replied to.
+type StoryReference struct {
+	SourceID   string                  `json:"source_id"`
+	SourceType table.ReplySourceTypeV2 `json:"source_type"`
+	// LegacySourceType is the V1 reply source type, which is what the send task expects.
+	LegacySourceType int64 `json:"legacy_source_type,omitempty"`
+	OwnerID          int64 `json:"owner_id,omitempty"`
+}
+
+// MessageMention is a mention in the text of a Messenger message.
+// Edits from Meta don't include mention data, so the mentioned text is stored to find the mentions in edited text.
+type MessageMention struct {
+	UserID int64  `json:"user_id"`
+	Type   string `json:"type"`
+	Text   string `json:"text"`
 }
 
 type GhostMetadata struct {
 	Username string `json:"username,omitempty"`
+
+	// Profile details that don't fit in the Matrix profile. Only details that are the same for every viewer
+	// are stored here, the follow relationship is stored in the metadata of DM portals instead.
+	Verified   bool   `json:"verified,omitempty"`
+	Biography  string `json:"biography,omitempty"`
+	IsBusiness bool   `json:"is_business,omitempty"`
+	// ProfileFetchedAt is the unix millisecond timestamp of the last full Instagram profile fetch.
+	ProfileFetchedAt int64 `json:"profile_fetched_at,omitempty"`
+}
+
+// FollowStatus is the Instagram follow relationship between a user login and the other user in a DM.
+type FollowStatus struct {
+	Following      bool  `json:"following"`
+	FollowedBy     bool  `json:"followed_by"`
+	IGFollowStatus int64 `json:"ig_follow_status,omitempty"`
 }
 
 type UserLoginMetadata struct {
 	Platform   types.Platform   `json:"platform"`
 	Cookies    *cookies.Cookies `json:"cookies"`
 	WADeviceID uint16           `json:"wa_device_id,omitempty"`
+
+	// PushKeys and PushSecret are used for receiving web push notifications when push wakeup is enabled.
+	PushKeys   *cookies.PushKeys `json:"push_keys,omitempty"`
+	PushSecret string            `json:"push_secret,omitempty"`
 }
 
 type PortalMetadata struct {
 	ThreadType     table.ThreadType `json:"thread_type"`
 	WhatsAppServer string           `json:"whatsapp_server,omitempty"`
+	// EphemeralSettingTS is the timestamp of the last disappearing timer change in WhatsApp threads.
+	EphemeralSettingTS int64 `json:"ephemeral_setting_ts,omitempty"`
+	// CannotUnsendReason is set if messages in the thread can't be unsent at all.
+	CannotUnsendReason table.MessageUnsendabilityStatus `json:"cannot_unsend_reason,omitempty"`
+	// CommunityMemberCount is the member count of a community when its member list was last synced.
+	CommunityMemberCount int64 `json:"community_member_count,omitempty"`
+	// TQSeqID is the last seen thread queue sequence ID of a community thread, used for hole detection.
+	TQSeqID int64 `json:"tq_seq_id,omitempty"`
+	// FollowStatus is the follow relationship with the other user in Instagram DMs.
+	FollowStatus *FollowStatus `json:"follow_status,omitempty"`
 
 	FetchAttempted atomic.Bool `json:"-"`
 }
@@ -86,9 +86,21 @@ func (p ParsedFBMessageID) String() string {
 	return fmt.Sprintf("%s:%s", MessageIDPrefixFB, p.ID)
 }
 
+// ParsedPendingMessageID is a placeholder ID of a sent message whose real ID isn't known yet.
+type ParsedPendingMessageID struct {
+	OTID string
+}
+
+func (ParsedPendingMessageID) isParsedMessageID() {}
+
+func (p ParsedPendingMessageID) String() string {
+	return fmt.Sprintf("%s:%s", MessageIDPrefixPending, p.OTID)
+}
+
 const (
-	MessageIDPrefixFB = "fb"
-	MessageIDPrefixWA = "wa"
+	MessageIDPrefixFB      = "fb"
+	MessageIDPrefixWA      = "wa"
+	MessageIDPrefixPending = "fb-pending"
 )
 
 func MakeWAMessageID(chat, sender types.JID, id types.MessageID) networkid.MessageID {
@@ -99,6 +111,12 @@ func MakeFBMessageID(messageID string) networkid.MessageID {
 	return networkid.MessageID(fmt.Sprintf("%s:%s", MessageIDPrefixFB, messageID))
 }
 
+// MakePendingMessageID makes a placeholder ID for a sent message whose real ID isn't known yet.
+// The placeholder is replaced with the real ID when the echo of the message is received.
+func MakePendingMessageID(otid string) networkid.MessageID {
+	return networkid.MessageID(fmt.Sprintf("%s:%s", MessageIDPrefixPending, otid))
+}
+
 func MakeMessagePartID(i int) networkid.PartID {
 	if i == 0 {
 		return ""
@@ -114,6 +132,8 @@ func ParseMessageID(messageID networkid.MessageID) ParsedMessageID {
 	parts := strings.SplitN(string(messageID), ":", 4)
 	if len(parts) == 2 && parts[0] == MessageIDPrefixFB {
 		return ParsedFBMessageID{ID: parts[1]}
+	} else if len(parts) == 2 && parts[0] == MessageIDPrefixPending {
+		return ParsedPendingMessageID{OTID: parts[1]}
 	} else if len(parts) == 4 && parts[0] == MessageIDPrefixWA {
 		chat, err := types.ParseJID(parts[1])
 		if err != nil {
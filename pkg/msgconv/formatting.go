@@ -0,0 +1,118 @@
+// mautrix-meta - A Matrix-Facebook Messenger and Instagram DM puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package msgconv
+
+import (
+	"html"
+	"strings"
+	"unicode"
+)
+
+var messengerFormatTags = map[rune]string{
+	'*': "strong",
+	'_': "em",
+	'~': "del",
+	'`': "code",
+}
+
+func isFormatBoundary(r rune) bool {
+	return unicode.IsSpace(r) || unicode.IsPunct(r) || unicode.IsSymbol(r)
+}
+
+// findFormatEnd finds the closing marker for a span that opens at text[start].
+// The content must not start or end with whitespace, must not span lines,
+// and the closing marker must be followed by a boundary or the end of the text.
+func findFormatEnd(text []rune, start int) int {
+	marker := text[start]
+	if start+1 >= len(text) || unicode.IsSpace(text[start+1]) {
+		return -1
+	}
+	for i := start + 2; i < len(text); i++ {
+		switch {
+		case text[i] == '\n':
+			return -1
+		case text[i] != marker:
+			continue
+		case unicode.IsSpace(text[i-1]):
+			continue
+		case i+1 < len(text) && !isFormatBoundary(text[i+1]):
+			continue
+		}
+		return i
+	}
+	return -1
+}
+
+// messengerInlineToHTML converts inline Messenger markup (*bold*, _italic_, ~strikethrough~ and `code`) to HTML.
+// The returned bool is true if any markup was found.
+func messengerInlineToHTML(text []rune) (string, bool) {
+	var output strings.Builder
+	changed := false
+	plainStart := 0
+	flushPlain := func(end int) {
+		output.WriteString(strings.ReplaceAll(html.EscapeString(string(text[plainStart:end])), "\n", "<br>"))
+	}
+	for i := 0; i < len(text); i++ {
+		tag, isMarker := messengerFormatTags[text[i]]
+		if !isMarker || (i > 0 && !isFormatBoundary(text[i-1])) {
+			continue
+		}
+		end := findFormatEnd(text, i)
+		if end < 0 {
+			continue
+		}
+		flushPlain(i)
+		var inner string
+		if text[i] == '`' {
+			inner = html.EscapeString(string(text[i+1 : end]))
+		} else {
+			inner, _ = messengerInlineToHTML(text[i+1 : end])
+		}
+		output.WriteString("<" + tag + ">" + inner + "</" + tag + ">")
+		changed = true
+		i = end
+		plainStart = end + 1
+	}
+	flushPlain(len(text))
+	return output.String(), changed
+}
+
+// messengerMarkupToHTML converts Messenger's markdown-like markup to HTML.
+// Code blocks are delimited by triple backticks, everything else is handled by messengerInlineToHTML.
+// The returned bool is true if any markup was found.
+func messengerMarkupToHTML(text string) (string, bool) {
+	parts := strings.Split(text, "```")
+	if len(parts)%2 == 0 {
+		// Unterminated code block, treat the last opener as plain text
+		parts[len(parts)-2] += "```" + parts[len(parts)-1]
+		parts = parts[:len(parts)-1]
+	}
+	var output strings.Builder
+	changed := len(parts) > 1
+	for i, part := range parts {
+		if i%2 == 1 {
+			output.WriteString("<pre><code>")
+			output.WriteString(html.EscapeString(strings.TrimPrefix(part, "\n")))
+			output.WriteString("</code></pre>")
+			continue
+		}
+		converted, partChanged := messengerInlineToHTML([]rune(part))
+		output.WriteString(converted)
+		changed = changed || partChanged
+	}
+	return output.String(), changed
+}
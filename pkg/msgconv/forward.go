@@ -0,0 +1,94 @@
+// mautrix-meta - A Matrix-Facebook Messenger and Instagram DM puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package msgconv
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/event"
+
+	"go.mau.fi/mautrix-meta/pkg/messagix"
+	"go.mau.fi/mautrix-meta/pkg/metaid"
+)
+
+// forwardSourceKey is the extra content key that points bridged media at the Meta message it came from.
+// Matrix clients copy the content as-is when forwarding, so it survives into the forwarded event.
+const forwardSourceKey = "fi.mau.meta.forward_source"
+
+func setForwardableMedia(part *bridgev2.ConvertedMessagePart, attachmentFBID string) {
+	if attachmentFBID == "" {
+		return
+	}
+	mediaURI := part.Content.URL
+	if part.Content.File != nil {
+		mediaURI = part.Content.File.URL
+	}
+	part.DBMetadata = &metaid.MessageMetadata{
+		AttachmentFBID: attachmentFBID,
+		MediaURI:       mediaURI,
+	}
+}
+
+// getForwardSource checks if the given Matrix media event is a forward of media bridged from Meta.
+// The source is only trusted if the media URI matches the one the bridge uploaded for the source message.
+func (mc *MessageConverter) getForwardSource(ctx context.Context, client *messagix.Client, evt *event.Event, content *event.MessageEventContent) (messageID string, attachmentFBID int64) {
+	rawSource, ok := evt.Content.Raw[forwardSourceKey].(map[string]any)
+	if !ok {
+		return
+	}
+	sourceID, _ := rawSource["message_id"].(string)
+	sourcePartID, _ := rawSource["part_id"].(string)
+	parsedID, ok := metaid.ParseMessageID(networkid.MessageID(sourceID)).(metaid.ParsedFBMessageID)
+	if !ok {
+		return
+	}
+	log := zerolog.Ctx(ctx).With().Str("forward_source_id", sourceID).Str("forward_source_part_id", sourcePartID).Logger()
+	account, err := client.GetCurrentAccount()
+	if err != nil {
+		log.Err(err).Msg("Failed to get current account to check forward source")
+		return
+	}
+	receiver := metaid.MakeUserLoginID(account.GetFBID())
+	source, err := mc.Bridge.DB.Message.GetPartByID(ctx, receiver, networkid.MessageID(sourceID), networkid.PartID(sourcePartID))
+	if err != nil {
+		log.Err(err).Msg("Failed to get forward source message")
+		return
+	} else if source == nil {
+		log.Debug().Msg("Forward source message not found")
+		return
+	}
+	sourceMeta := source.Metadata.(*metaid.MessageMetadata)
+	mediaURI := content.URL
+	if content.File != nil {
+		mediaURI = content.File.URL
+	}
+	if sourceMeta.AttachmentFBID == "" || sourceMeta.MediaURI == "" || sourceMeta.MediaURI != mediaURI {
+		log.Debug().Msg("Media in forwarded message doesn't match source, reuploading")
+		return
+	}
+	attachmentFBID, err = strconv.ParseInt(sourceMeta.AttachmentFBID, 10, 64)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to parse attachment FBID of forward source")
+		return
+	}
+	log.Debug().Msg("Sending media as native forward")
+	return parsedID.ID, attachmentFBID
+}
@@ -20,7 +20,9 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/rs/zerolog"
@@ -90,7 +92,11 @@ func (mc *MessageConverter) ToMeta(
 	}
 	if replyTo != nil {
 		msgID, ok := metaid.ParseMessageID(replyTo.ID).(metaid.ParsedFBMessageID)
-		if ok {
+		if story := getStoryReference(replyTo); story != nil {
+			// Replies to story replies/reactions are sent as replies to the story itself,
+			// as that's how they're shown in the Meta apps.
+			task.ReplyMetaData = storyReplyMetaData(story)
+		} else if ok {
 			task.ReplyMetaData = &socket.ReplyMetaData{
 				ReplyMessageId:  msgID.ID,
 				ReplySourceType: 1,
@@ -105,28 +111,56 @@ func (mc *MessageConverter) ToMeta(
 			content.FormattedBody = "/me " + content.FormattedBody
 		}
 	}
+	if isMatrixViewOnce(evt) {
+		return nil, 0, fmt.Errorf("%w: view-once media can only be sent in encrypted chats", bridgev2.ErrUnsupportedMessageType)
+	}
 	switch content.MsgType {
 	case event.MsgText, event.MsgNotice, event.MsgEmote:
-		if content.Format == event.FormatHTML {
-			mc.parseFormattedBody(ctx, content, task, portal)
-		} else {
-			task.Text = content.Body
+		task.Text, task.MentionData = mc.matrixTextToMeta(ctx, content, portal)
+		if content.MsgType == event.MsgText && client.Instagram != nil {
+			if permalink := mc.resolveInstagramMediaLink(ctx, client.Instagram, task.Text); permalink != "" {
+				task.Text = permalink
+				task.MentionData = nil
+				task.TextHasLinks = 1
+			}
 		}
 	case event.MsgImage, event.MsgVideo, event.MsgAudio, event.MsgFile:
-		resp, err := mc.reuploadFileToMeta(ctx, client, portal, content)
+		if sourceID, attachmentID := mc.getForwardSource(ctx, client, evt, content); sourceID != "" {
+			task.SendType = table.FORWARD
+			task.ForwardedMsgId = sourceID
+			task.AttachmentFBIds = []int64{attachmentID}
+			break
+		}
+		attachmentID, err := mc.uploadAttachmentToMeta(ctx, client, portal, content)
 		if err != nil {
 			return nil, 0, err
 		}
-		attachmentID := resp.Payload.RealMetadata.GetFbId()
-		if attachmentID == 0 {
-			zerolog.Ctx(ctx).Warn().RawJSON("response", resp.Raw).Msg("No fbid received for upload")
-			return nil, 0, fmt.Errorf("failed to upload attachment: fbid not received")
-		}
 		task.SendType = table.MEDIA
 		task.AttachmentFBIds = []int64{attachmentID}
 		if content.FileName != "" && content.Body != content.FileName {
 			// This might not actually be allowed
-			task.Text = content.Body
+			task.Text, task.MentionData = mc.matrixTextToMeta(ctx, content, portal)
+		}
+	case event.MsgBeeperGallery:
+		if len(content.BeeperGalleryImages) == 0 {
+			return nil, 0, fmt.Errorf("%w: empty gallery", bridgev2.ErrUnsupportedMessageType)
+		}
+		attachmentIDs, err := mc.uploadGalleryToMeta(ctx, client, portal, content.BeeperGalleryImages)
+		if err != nil {
+			return nil, 0, err
+		}
+		task.SendType = table.MEDIA
+		task.AttachmentFBIds = attachmentIDs
+		if content.BeeperGalleryCaption != "" {
+			caption := &event.MessageEventContent{
+				MsgType: event.MsgText,
+				Body:    content.BeeperGalleryCaption,
+			}
+			if content.BeeperGalleryCaptionHTML != "" {
+				caption.Format = event.FormatHTML
+				caption.FormattedBody = content.BeeperGalleryCaptionHTML
+			}
+			task.Text, task.MentionData = mc.matrixTextToMeta(ctx, caption, portal)
 		}
 	case event.MsgLocation:
 		// TODO implement
@@ -143,6 +177,63 @@ func (mc *MessageConverter) ToMeta(
 	return []socket.Task{task, readTask}, task.Otid, nil
 }
 
+// getStoryReference returns the story that the given message replied or reacted to, if any.
+// Messages bridged before the V1 source type was stored are treated as normal messages,
+// as the story can't be referenced without it.
+func getStoryReference(msg *database.Message) *metaid.StoryReference {
+	meta, _ := msg.Metadata.(*metaid.MessageMetadata)
+	if meta == nil || meta.StoryReply == nil || meta.StoryReply.LegacySourceType == 0 {
+		return nil
+	}
+	return meta.StoryReply
+}
+
+func storyReplyMetaData(story *metaid.StoryReference) *socket.ReplyMetaData {
+	return &socket.ReplyMetaData{
+		ReplyMessageId:  story.SourceID,
+		ReplySourceType: story.LegacySourceType,
+		ReplyType:       0,
+		ReplySender:     story.OwnerID,
+		StoryOwner:      story.OwnerID,
+	}
+}
+
+var instagramMediaLinkRegex = regexp.MustCompile(`^https?://(?:www\.)?instagram\.com/(?:[a-z0-9._]{1,30}/)?(?:p|reels?|tv)/([A-Za-z0-9_-]+)/?(?:\?\S*)?$`)
+
+// resolveInstagramMediaLink checks if the message is just a link to an Instagram post or reel,
+// and returns the canonical permalink of the media if it exists. Empty string is returned if the message
+// isn't a media link or the media couldn't be fetched, in which case the message is sent as-is.
+//
+// The permalink is sent as a normal text message: the send type and fields of native media shares
+// haven't been confirmed from a captured payload yet.
+func (mc *MessageConverter) resolveInstagramMediaLink(ctx context.Context, ig *messagix.InstagramMethods, text string) string {
+	match := instagramMediaLinkRegex.FindStringSubmatch(strings.TrimSpace(text))
+	if match == nil {
+		return ""
+	}
+	shortcode := match[1]
+	log := zerolog.Ctx(ctx).With().Str("shortcode", shortcode).Logger()
+	mediaID, err := messagix.ShortcodeToMediaID(shortcode)
+	if err != nil {
+		log.Debug().Err(err).Msg("Failed to parse Instagram media shortcode")
+		return ""
+	}
+	resp, err := mc.fetchMediaCached(ctx, ig, mediaID, shortcode)
+	if err != nil {
+		log.Err(err).Str("media_id", mediaID).Msg("Failed to fetch linked Instagram media, sending as text")
+		return ""
+	} else if len(resp.Items) == 0 || resp.Items[0].Code == "" {
+		log.Warn().Str("media_id", mediaID).Msg("Linked Instagram media not found, sending as text")
+		return ""
+	}
+	item := resp.Items[0]
+	log.Debug().Str("media_id", item.Pk).Msg("Resolved linked Instagram media")
+	if item.ProductType == "clips" {
+		return fmt.Sprintf("https://www.instagram.com/reel/%s/", item.Code)
+	}
+	return fmt.Sprintf("https://www.instagram.com/p/%s/", item.Code)
+}
+
 const mentionLocator = "meta_mention_"
 
 type MetaMention struct {
@@ -199,7 +290,41 @@ func (mc *MessageConverter) convertPill(displayname, mxid, eventID string, ctx f
 	return mention.Locator
 }
 
-func (mc *MessageConverter) parseFormattedBody(ctx context.Context, content *event.MessageEventContent, task *socket.SendMessageTask, portal *bridgev2.Portal) {
+// ToMetaEdit converts a Matrix edit into an edit task. Edits of media messages can only change the caption.
+func (mc *MessageConverter) ToMetaEdit(
+	ctx context.Context,
+	messageID string,
+	content *event.MessageEventContent,
+	portal *bridgev2.Portal,
+) (*socket.EditMessageTask, error) {
+	task := &socket.EditMessageTask{MessageID: messageID}
+	switch content.MsgType {
+	case event.MsgText, event.MsgNotice, event.MsgEmote:
+	case event.MsgImage, event.MsgVideo, event.MsgAudio, event.MsgFile:
+		if content.FileName == "" || content.Body == content.FileName {
+			return nil, fmt.Errorf("%w: media edits must have a caption", bridgev2.ErrUnsupportedMessageType)
+		}
+	default:
+		return nil, fmt.Errorf("%w %s", bridgev2.ErrUnsupportedMessageType, content.MsgType)
+	}
+	if content.MsgType == event.MsgEmote {
+		content.Body = "/me " + content.Body
+		if content.FormattedBody != "" {
+			content.FormattedBody = "/me " + content.FormattedBody
+		}
+	}
+	task.Text, task.MentionData = mc.matrixTextToMeta(ctx, content, portal)
+	return task, nil
+}
+
+func (mc *MessageConverter) matrixTextToMeta(ctx context.Context, content *event.MessageEventContent, portal *bridgev2.Portal) (string, *socket.MentionData) {
+	if content.Format != event.FormatHTML {
+		return content.Body, nil
+	}
+	return mc.parseFormattedBody(ctx, content, portal)
+}
+
+func (mc *MessageConverter) parseFormattedBody(ctx context.Context, content *event.MessageEventContent, portal *bridgev2.Portal) (string, *socket.MentionData) {
 	mentions := make([]*MetaMention, 0)
 
 	parseCtx := format.NewContext(ctx)
@@ -226,8 +351,44 @@ func (mc *MessageConverter) parseFormattedBody(ctx context.Context, content *eve
 		})
 	}
 
-	task.MentionData = socketMentions.ToData()
-	task.Text = parsed
+	return parsed, socketMentions.ToData()
+}
+
+func (mc *MessageConverter) uploadAttachmentToMeta(ctx context.Context, client *messagix.Client, portal *bridgev2.Portal, content *event.MessageEventContent) (int64, error) {
+	resp, err := mc.reuploadFileToMeta(ctx, client, portal, content)
+	if err != nil {
+		return 0, err
+	}
+	attachmentID := resp.Payload.RealMetadata.GetFbId()
+	if attachmentID == 0 {
+		zerolog.Ctx(ctx).Warn().RawJSON("response", resp.Raw).Msg("No fbid received for upload")
+		return 0, fmt.Errorf("failed to upload attachment: fbid not received")
+	}
+	return attachmentID, nil
+}
+
+// uploadGalleryToMeta uploads all the media in a gallery in parallel, so that they can be sent as one album.
+func (mc *MessageConverter) uploadGalleryToMeta(ctx context.Context, client *messagix.Client, portal *bridgev2.Portal, images []*event.MessageEventContent) ([]int64, error) {
+	attachmentIDs := make([]int64, len(images))
+	errs := make([]error, len(images))
+	var wg sync.WaitGroup
+	wg.Add(len(images))
+	for i, image := range images {
+		go func() {
+			defer wg.Done()
+			if image.Info == nil {
+				image.Info = &event.FileInfo{}
+			}
+			attachmentIDs[i], errs[i] = mc.uploadAttachmentToMeta(ctx, client, portal, image)
+		}()
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			return nil, fmt.Errorf("failed to upload gallery item #%d: %w", i+1, err)
+		}
+	}
+	return attachmentIDs, nil
 }
 
 func (mc *MessageConverter) reuploadFileToMeta(ctx context.Context, client *messagix.Client, portal *bridgev2.Portal, content *event.MessageEventContent) (*types.MercuryUploadResponse, error) {
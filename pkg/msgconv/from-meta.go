@@ -31,6 +31,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gabriel-vasile/mimetype"
 	"github.com/rs/zerolog"
@@ -39,6 +40,7 @@ import (
 	"go.mau.fi/util/ptr"
 	_ "golang.org/x/image/webp"
 	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
 	"maunium.net/go/mautrix/bridgev2/networkid"
 	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
@@ -122,6 +124,10 @@ func (mc *MessageConverter) ToMatrix(
 			MentionTypes:   msg.MentionTypes,
 		}
 		content := mc.MetaToMatrixText(ctx, msg.Text, mentions, portal)
+		partMeta := &metaid.MessageMetadata{
+			IsTextPart: true,
+			Mentions:   mentionsToMetadata(ctx, msg.Text, mentions),
+		}
 		if msg.IsAdminMessage {
 			content.MsgType = event.MsgNotice
 		}
@@ -165,9 +171,10 @@ func (mc *MessageConverter) ToMatrix(
 		}
 
 		cm.Parts = append(cm.Parts, &bridgev2.ConvertedMessagePart{
-			Type:    event.EventMessage,
-			Content: content,
-			Extra:   extra,
+			Type:       event.EventMessage,
+			Content:    content,
+			Extra:      extra,
+			DBMetadata: partMeta,
 		})
 	}
 	if len(cm.Parts) == 0 {
@@ -192,9 +199,27 @@ func (mc *MessageConverter) ToMatrix(
 	if msg.ThreadID != "" {
 		cm.ThreadRoot = ptr.Ptr(metaid.MakeFBMessageID(msg.ThreadID))
 	}
+	var storyRef *metaid.StoryReference
+	if msg.ReplySourceId != "" && isStoryReplySource(msg.ReplySourceTypeV2) {
+		storyRef = &metaid.StoryReference{
+			SourceID:         msg.ReplySourceId,
+			SourceType:       msg.ReplySourceTypeV2,
+			LegacySourceType: msg.ReplySourceType,
+			OwnerID:          msg.ReplyToUserId,
+		}
+	}
 
 	for i, part := range cm.Parts {
 		part.ID = metaid.MakeMessagePartID(i)
+		if partMeta, ok := part.DBMetadata.(*metaid.MessageMetadata); ok && partMeta.AttachmentFBID != "" {
+			if part.Extra == nil {
+				part.Extra = make(map[string]any)
+			}
+			part.Extra[forwardSourceKey] = map[string]any{
+				"message_id": metaid.MakeFBMessageID(msg.MessageId),
+				"part_id":    part.ID,
+			}
+		}
 		_, hasExternalURL := part.Extra["external_url"]
 		unsupported, _ := part.Extra["fi.mau.unsupported"].(bool)
 		if unsupported && !hasExternalURL {
@@ -218,7 +243,28 @@ func (mc *MessageConverter) ToMatrix(
 		if part.Content.Mentions == nil {
 			part.Content.Mentions = &event.Mentions{}
 		}
+		if msg.CannotUnsendReason != table.CAN_UNSEND || storyRef != nil {
+			partMeta, ok := part.DBMetadata.(*metaid.MessageMetadata)
+			if !ok {
+				partMeta = &metaid.MessageMetadata{}
+				part.DBMetadata = partMeta
+			}
+			partMeta.CannotUnsendReason = msg.CannotUnsendReason
+			partMeta.StoryReply = storyRef
+		}
+	}
+	if msg.EphemeralDurationInSec > 0 {
+		cm.Disappear = database.DisappearingSetting{
+			Type:  database.DisappearingTypeAfterRead,
+			Timer: time.Duration(msg.EphemeralDurationInSec) * time.Second,
+		}
+		if msg.EphemeralExpirationTs > 0 {
+			// The timer has already been started on the Meta side
+			cm.Disappear.Type = database.DisappearingTypeAfterSend
+			cm.Disappear.DisappearAt = time.UnixMilli(msg.EphemeralExpirationTs)
+		}
 	}
+	mc.applyViewOnceDisappear(cm)
 	return cm
 }
 
@@ -242,6 +288,10 @@ func errorToNotice(err error, attachmentContainerType string) *bridgev2.Converte
 }
 
 func (mc *MessageConverter) blobAttachmentToMatrix(ctx context.Context, att *table.LSInsertBlobAttachment) *bridgev2.ConvertedMessagePart {
+	viewOnce := att.AttachmentType.IsEphemeral()
+	if viewOnce && !mc.shouldDownloadViewOnce() {
+		return mc.viewOncePlaceholder(false)
+	}
 	url := att.PlayableUrl
 	mime := att.PlayableUrlMimeType
 	if mime == "" {
@@ -259,10 +309,19 @@ func (mc *MessageConverter) blobAttachmentToMatrix(ctx context.Context, att *tab
 		zerolog.Ctx(ctx).Err(err).Msg("Failed to transfer blob media")
 		return errorToNotice(err, "blob")
 	}
+	if viewOnce {
+		mc.markViewOnce(converted)
+	} else {
+		setForwardableMedia(converted, att.AttachmentFbid)
+	}
 	return converted
 }
 
 func (mc *MessageConverter) legacyAttachmentToMatrix(ctx context.Context, att *table.LSInsertAttachment) *bridgev2.ConvertedMessagePart {
+	viewOnce := att.AttachmentType.IsEphemeral() || att.EphemeralMediaState != table.EphemeralMediaStatePermanent
+	if viewOnce && (!mc.shouldDownloadViewOnce() || att.EphemeralMediaState == table.EphemeralMediaStateExpired) {
+		return mc.viewOncePlaceholder(att.EphemeralMediaState == table.EphemeralMediaStateExpired)
+	}
 	url := att.PlayableUrl
 	mime := att.PlayableUrlMimeType
 	if mime == "" {
@@ -280,6 +339,11 @@ func (mc *MessageConverter) legacyAttachmentToMatrix(ctx context.Context, att *t
 		zerolog.Ctx(ctx).Err(err).Msg("Failed to transfer media")
 		return errorToNotice(err, "generic")
 	}
+	if viewOnce {
+		mc.markViewOnce(converted)
+	} else {
+		setForwardableMedia(converted, att.AttachmentFbid)
+	}
 	return converted
 }
 
@@ -323,6 +387,33 @@ func (mc *MessageConverter) instagramFetchedMediaToMatrix(ctx context.Context, a
 	return mc.reuploadAttachment(ctx, att.AttachmentType, url, att.Filename, mime, width, height, int(resp.VideoDuration*1000))
 }
 
+// fetchedXMAItemToMatrix reuploads a fetched Instagram item, using the minimal XMA conversion as the thumbnail,
+// or returns the minimal conversion if reuploading fails.
+func (mc *MessageConverter) fetchedXMAItemToMatrix(
+	ctx context.Context, att *table.WrappedXMA, item *responses.Items, username, externalURL string, minimalConverted *bridgev2.ConvertedMessagePart,
+) *bridgev2.ConvertedMessagePart {
+	if username != "" {
+		minimalConverted.Extra["com.beeper.instagram_item_username"] = username
+	}
+	converted, err := mc.instagramFetchedMediaToMatrixCached(ctx, att, item, minimalConverted)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Msg("Failed to transfer fetched media")
+		minimalConverted.Extra["fi.mau.meta.xma_fetch_status"] = "reupload fail"
+		return minimalConverted
+	}
+	converted.Content.Info.ThumbnailInfo = minimalConverted.Content.Info
+	converted.Content.Info.ThumbnailURL = minimalConverted.Content.URL
+	converted.Content.Info.ThumbnailFile = minimalConverted.Content.File
+	if username != "" {
+		converted.Extra["com.beeper.instagram_item_username"] = username
+	}
+	if externalURL != "" {
+		converted.Extra["external_url"] = externalURL
+	}
+	converted.Extra["fi.mau.meta.xma_fetch_status"] = "success"
+	return converted
+}
+
 func (mc *MessageConverter) xmaLocationToMatrix(ctx context.Context, att *table.WrappedXMA) *bridgev2.ConvertedMessagePart {
 	if att.CTA.NativeUrl == "" {
 		// This happens for live locations
@@ -346,6 +437,8 @@ func (mc *MessageConverter) xmaLocationToMatrix(ctx context.Context, att *table.
 }
 
 var reelActionURLRegex = regexp.MustCompile(`^/stories/direct/(\d+)_(\d+)$`)
+var archivedStoryActionURLRegex = regexp.MustCompile(`^/stories/archive/(\d+)(?:_\d+)?/?$`)
+var highlightActionURLRegex = regexp.MustCompile(`^(?:https://(?:www\.)?instagram\.com)?/stories/highlights/(\d+)/?(?:\?.*)?$`)
 var reelActionURLRegex2 = regexp.MustCompile(`^https://instagram\.com/stories/([a-z0-9.-_]{3,32})/(\d+)$`)
 var usernameRegex = regexp.MustCompile(`^[a-z0-9.-_]{3,32}$`)
 var ErrURLNotFound = errors.New("url not found")
@@ -392,6 +485,16 @@ func addExternalURLCaption(content *event.MessageEventContent, externalURL strin
 	}
 }
 
+func isStoryReplySource(sourceType table.ReplySourceTypeV2) bool {
+	switch sourceType {
+	case table.ReplySourceTypeStory, table.ReplySourceTypeFBStoryShare, table.ReplySourceTypeIGStoryShare,
+		table.ReplySourceTypeStoryBase64Encoded, table.ReplySourceTypeCloseFriends:
+		return true
+	default:
+		return false
+	}
+}
+
 func (mc *MessageConverter) fetchFullXMA(ctx context.Context, att *table.WrappedXMA, minimalConverted *bridgev2.ConvertedMessagePart) *bridgev2.ConvertedMessagePart {
 	ig := ctx.Value(contextKeyFBClient).(*messagix.Client).Instagram
 	if att.CTA == nil || ig == nil {
@@ -419,7 +522,7 @@ func (mc *MessageConverter) fetchFullXMA(ctx context.Context, att *table.Wrapped
 		}
 
 		log.Trace().Any("cta_data", att.CTA).Msg("Fetching XMA media from CTA data")
-		resp, err := ig.FetchMedia(strconv.FormatInt(att.CTA.TargetId, 10), mediaShortcode)
+		resp, err := mc.fetchMediaCached(ctx, ig, strconv.FormatInt(att.CTA.TargetId, 10), mediaShortcode)
 		if err != nil {
 			log.Err(err).Int64("target_id", att.CTA.TargetId).Msg("Failed to fetch XMA media")
 			minimalConverted.Extra["fi.mau.meta.xma_fetch_status"] = "fetch fail"
@@ -440,7 +543,7 @@ func (mc *MessageConverter) fetchFullXMA(ctx context.Context, att *table.Wrapped
 					}
 				}
 			}
-			secondConverted, err := mc.instagramFetchedMediaToMatrix(ctx, att, targetItem)
+			secondConverted, err := mc.instagramFetchedMediaToMatrixCached(ctx, att, targetItem, minimalConverted)
 			if err != nil {
 				zerolog.Ctx(ctx).Err(err).Msg("Failed to transfer fetched media")
 				minimalConverted.Extra["fi.mau.meta.xma_fetch_status"] = "reupload fail"
@@ -477,7 +580,7 @@ func (mc *MessageConverter) fetchFullXMA(ctx context.Context, att *table.Wrapped
 			log.Warn().Str("action_url", att.CTA.ActionUrl).Msg("Failed to parse story action URL")
 			minimalConverted.Extra["fi.mau.meta.xma_fetch_status"] = "parse fail"
 			return minimalConverted
-		} else if resp, err := ig.FetchReel([]string{match[2]}, match[1]); err != nil {
+		} else if resp, err := mc.fetchReelCached(ctx, ig, match[2], match[1]); err != nil {
 			log.Err(err).Str("action_url", att.CTA.ActionUrl).Msg("Failed to fetch XMA story")
 			minimalConverted.Extra["fi.mau.meta.xma_fetch_status"] = "fetch fail"
 			return minimalConverted
@@ -524,7 +627,7 @@ func (mc *MessageConverter) fetchFullXMA(ctx context.Context, att *table.Wrapped
 				return minimalConverted
 			}
 			log.Debug().Msg("Fetched XMA story and found exact item")
-			secondConverted, err := mc.instagramFetchedMediaToMatrix(ctx, att, relevantItem)
+			secondConverted, err := mc.instagramFetchedMediaToMatrixCached(ctx, att, relevantItem, minimalConverted)
 			if err != nil {
 				zerolog.Ctx(ctx).Err(err).Msg("Failed to transfer fetched media")
 				minimalConverted.Extra["fi.mau.meta.xma_fetch_status"] = "reupload fail"
@@ -540,8 +643,90 @@ func (mc *MessageConverter) fetchFullXMA(ctx context.Context, att *table.Wrapped
 			secondConverted.Extra["fi.mau.meta.xma_fetch_status"] = "success"
 			return secondConverted
 		}
-	//case strings.HasPrefix(att.CTA.ActionUrl, "/stories/archive/"):
-	//		TODO can these be handled?
+	case strings.HasPrefix(att.CTA.ActionUrl, "/stories/archive/"):
+		// Archived stories are only visible to the owner, so there's no external URL to add
+		log.Trace().Any("cta_data", att.CTA).Msg("Fetching archived XMA story from CTA data")
+		if !mc.ShouldFetchXMA(ctx) {
+			log.Debug().Msg("Not fetching XMA media")
+			minimalConverted.Extra["fi.mau.meta.xma_fetch_status"] = "skip"
+			return minimalConverted
+		}
+		if match := archivedStoryActionURLRegex.FindStringSubmatch(att.CTA.ActionUrl); len(match) != 2 {
+			log.Warn().Str("action_url", att.CTA.ActionUrl).Msg("Failed to parse archived story action URL")
+			minimalConverted.Extra["fi.mau.meta.xma_fetch_status"] = "parse fail"
+			return minimalConverted
+		} else if resp, err := mc.fetchMediaCached(ctx, ig, match[1], ""); err != nil {
+			log.Err(err).Str("action_url", att.CTA.ActionUrl).Msg("Failed to fetch archived XMA story")
+			minimalConverted.Extra["fi.mau.meta.xma_fetch_status"] = "fetch fail"
+			return minimalConverted
+		} else if len(resp.Items) == 0 {
+			log.Warn().
+				Str("action_url", att.CTA.ActionUrl).
+				Str("media_id", match[1]).
+				Str("response_status", resp.Status).
+				Msg("Got empty archived XMA story response")
+			minimalConverted.Extra["fi.mau.meta.xma_fetch_status"] = "empty response"
+			return minimalConverted
+		} else {
+			log.Debug().Msg("Fetched archived XMA story")
+			return mc.fetchedXMAItemToMatrix(ctx, att, resp.Items[0], resp.Items[0].User.Username, "", minimalConverted)
+		}
+	case highlightActionURLRegex.MatchString(att.CTA.ActionUrl):
+		log.Trace().Any("cta_data", att.CTA).Msg("Fetching XMA highlight from CTA data")
+		match := highlightActionURLRegex.FindStringSubmatch(att.CTA.ActionUrl)
+		highlightID := "highlight:" + match[1]
+		externalURL := fmt.Sprintf("https://www.instagram.com/stories/highlights/%s/", match[1])
+		minimalConverted.Extra["external_url"] = externalURL
+		addExternalURLCaption(minimalConverted.Content, externalURL)
+		if !mc.ShouldFetchXMA(ctx) {
+			log.Debug().Msg("Not fetching XMA media")
+			minimalConverted.Extra["fi.mau.meta.xma_fetch_status"] = "skip"
+			return minimalConverted
+		}
+		// The specific story in the highlight is optional, the first item (usually the cover) is used if it's not set
+		var storyMediaID string
+		if actionURL, _ := url.Parse(att.CTA.ActionUrl); actionURL != nil {
+			storyMediaID, _, _ = strings.Cut(actionURL.Query().Get("story_media_id"), "_")
+		}
+		if resp, err := mc.fetchHighlightCached(ctx, ig, highlightID); err != nil {
+			log.Err(err).Str("action_url", att.CTA.ActionUrl).Msg("Failed to fetch XMA highlight")
+			minimalConverted.Extra["fi.mau.meta.xma_fetch_status"] = "fetch fail"
+			return minimalConverted
+		} else if reel, ok := resp.Reels[highlightID]; !ok || len(reel.Items) == 0 {
+			log.Warn().
+				Str("action_url", att.CTA.ActionUrl).
+				Str("highlight_id", highlightID).
+				Str("response_status", resp.Status).
+				Msg("Got empty XMA highlight response")
+			minimalConverted.Extra["fi.mau.meta.xma_fetch_status"] = "empty response"
+			return minimalConverted
+		} else {
+			relevantItem := &reel.Items[0].Items
+			if storyMediaID != "" {
+				relevantItem = nil
+				for _, item := range reel.Items {
+					if item.Pk == storyMediaID {
+						relevantItem = &item.Items
+						break
+					}
+				}
+			}
+			if relevantItem == nil {
+				log.Warn().
+					Str("action_url", att.CTA.ActionUrl).
+					Str("highlight_id", highlightID).
+					Str("media_id", storyMediaID).
+					Msg("Failed to find exact item in fetched XMA highlight")
+				minimalConverted.Extra["fi.mau.meta.xma_fetch_status"] = "item not found in response"
+				return minimalConverted
+			}
+			log.Debug().Str("highlight_title", reel.Title).Msg("Fetched XMA highlight")
+			var username string
+			if reel.User != nil {
+				username = reel.User.Username
+			}
+			return mc.fetchedXMAItemToMatrix(ctx, att, relevantItem, username, externalURL, minimalConverted)
+		}
 	case strings.HasPrefix(att.CTA.ActionUrl, "https://instagram.com/stories/"):
 		log.Trace().Any("cta_data", att.CTA).Msg("Fetching second type of XMA story from CTA data")
 		externalURL := att.CTA.ActionUrl
@@ -557,7 +742,7 @@ func (mc *MessageConverter) fetchFullXMA(ctx context.Context, att *table.Wrapped
 			log.Warn().Str("action_url", att.CTA.ActionUrl).Msg("Failed to parse story action URL (type 2)")
 			minimalConverted.Extra["fi.mau.meta.xma_fetch_status"] = "parse fail"
 			return minimalConverted
-		} else if resp, err := ig.FetchMedia(match[2], ""); err != nil {
+		} else if resp, err := mc.fetchMediaCached(ctx, ig, match[2], ""); err != nil {
 			log.Err(err).Str("action_url", att.CTA.ActionUrl).Msg("Failed to fetch XMA story (type 2)")
 			minimalConverted.Extra["fi.mau.meta.xma_fetch_status"] = "fetch fail"
 			return minimalConverted
@@ -584,7 +769,7 @@ func (mc *MessageConverter) fetchFullXMA(ctx context.Context, att *table.Wrapped
 				Msg("Fetched XMA story (type 2)")
 			minimalConverted.Extra["com.beeper.instagram_item_username"] = relevantItem.User.Username
 			log.Debug().Int("item_count", len(resp.Items)).Msg("Fetched XMA story (type 2)")
-			secondConverted, err := mc.instagramFetchedMediaToMatrix(ctx, att, relevantItem)
+			secondConverted, err := mc.instagramFetchedMediaToMatrixCached(ctx, att, relevantItem, minimalConverted)
 			if err != nil {
 				zerolog.Ctx(ctx).Err(err).Msg("Failed to transfer fetched media")
 				minimalConverted.Extra["fi.mau.meta.xma_fetch_status"] = "reupload fail"
@@ -634,6 +819,91 @@ func (mc *MessageConverter) xmaProfileShareToMatrix(ctx context.Context, att *ta
 	}
 }
 
+var marketplaceListingURLRegex = regexp.MustCompile(`^https://(?:www\.|m\.|web\.)?facebook\.com/marketplace/item/(\d+)`)
+
+// getProductListingURL returns the link to the product if the XMA is a product or Marketplace listing share.
+// Shares are only detected based on their explicit target: the CTA must point at the listing itself,
+// either with a native shopping/Marketplace link or with a Marketplace item link for the same target ID.
+// Normal link shares (even ones linking to Marketplace) don't have a target, so they stay as URL previews.
+func getProductListingURL(att *table.WrappedXMA) (listingURL, listingID string, ok bool) {
+	if att.CTA == nil || att.CTA.TargetId == 0 {
+		return
+	}
+	listingID = strconv.FormatInt(att.CTA.TargetId, 10)
+	listingURL = removeLPHP(att.CTA.ActionUrl)
+	if match := marketplaceListingURLRegex.FindStringSubmatch(listingURL); match != nil && match[1] == listingID {
+		return listingURL, listingID, true
+	} else if strings.HasPrefix(att.CTA.NativeUrl, "instagram://shopping") ||
+		strings.HasPrefix(att.CTA.NativeUrl, "fb://marketplace") {
+		return listingURL, listingID, true
+	}
+	return "", "", false
+}
+
+// xmaProductToMatrix converts product and Marketplace listing shares into a single image with a rich caption,
+// as the generic XMA conversion only keeps the title.
+func (mc *MessageConverter) xmaProductToMatrix(ctx context.Context, att *table.WrappedXMA) *bridgev2.ConvertedMessagePart {
+	listingURL, listingID, ok := getProductListingURL(att)
+	if !ok {
+		return nil
+	}
+	var plainLines, htmlLines []string
+	if att.TitleText != "" {
+		plainLines = append(plainLines, att.TitleText)
+		if listingURL != "" {
+			htmlLines = append(htmlLines, fmt.Sprintf(`<strong><a href="%s">%s</a></strong>`, html.EscapeString(listingURL), html.EscapeString(att.TitleText)))
+		} else {
+			htmlLines = append(htmlLines, fmt.Sprintf("<strong>%s</strong>", html.EscapeString(att.TitleText)))
+		}
+	}
+	// The subtitle contains the price (and sometimes the location) of the listing
+	for _, line := range []string{att.SubtitleText, att.DescriptionText} {
+		if line != "" {
+			plainLines = append(plainLines, line)
+			htmlLines = append(htmlLines, html.EscapeString(line))
+		}
+	}
+	if listingURL != "" {
+		plainLines = append(plainLines, listingURL)
+	}
+	caption := &event.MessageEventContent{
+		MsgType:       event.MsgText,
+		Body:          strings.Join(plainLines, "\n"),
+		Format:        event.FormatHTML,
+		FormattedBody: strings.Join(htmlLines, "<br>"),
+	}
+	converted := &bridgev2.ConvertedMessagePart{
+		Type:    event.EventMessage,
+		Content: caption,
+	}
+	if att.PreviewUrl != "" {
+		image, err := mc.reuploadAttachment(ctx, table.AttachmentTypeImage, att.PreviewUrl, "listing.jpg", att.PreviewUrlMimeType, int(att.PreviewWidth), int(att.PreviewHeight), 0)
+		if err != nil {
+			zerolog.Ctx(ctx).Err(err).Msg("Failed to reupload product image")
+		} else {
+			image.Content.FileName = image.Content.Body
+			image.Content.Body = caption.Body
+			image.Content.Format = caption.Format
+			image.Content.FormattedBody = caption.FormattedBody
+			converted = image
+		}
+	}
+	if converted.Extra == nil {
+		converted.Extra = make(map[string]any)
+	}
+	converted.Extra["com.beeper.meta.product"] = map[string]any{
+		"id":          listingID,
+		"title":       att.TitleText,
+		"subtitle":    att.SubtitleText,
+		"description": att.DescriptionText,
+		"url":         listingURL,
+	}
+	if listingURL != "" {
+		converted.Extra["external_url"] = listingURL
+	}
+	return converted
+}
+
 func (mc *MessageConverter) urlPreviewToBeeper(ctx context.Context, att *table.WrappedXMA) *event.BeeperLinkPreview {
 	preview := &event.BeeperLinkPreview{
 		LinkPreview: event.LinkPreview{
@@ -662,6 +932,8 @@ func (mc *MessageConverter) xmaAttachmentToMatrix(ctx context.Context, att *tabl
 		return []*bridgev2.ConvertedMessagePart{mc.xmaLocationToMatrix(ctx, att)}
 	} else if profileShare := mc.xmaProfileShareToMatrix(ctx, att); profileShare != nil {
 		return []*bridgev2.ConvertedMessagePart{profileShare}
+	} else if product := mc.xmaProductToMatrix(ctx, att); product != nil {
+		return []*bridgev2.ConvertedMessagePart{product}
 	}
 	url := att.PlayableUrl
 	mime := att.PlayableUrlMimeType
@@ -24,6 +24,7 @@ import (
 	_ "image/png"
 	"net/url"
 	"strings"
+	"time"
 
 	"github.com/rs/zerolog"
 	"go.mau.fi/util/exmime"
@@ -38,6 +39,7 @@ import (
 	"go.mau.fi/whatsmeow/types/events"
 	_ "golang.org/x/image/webp"
 	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
 	"maunium.net/go/mautrix/bridgev2/networkid"
 	"maunium.net/go/mautrix/event"
 
@@ -276,6 +278,151 @@ func (mc *MessageConverter) convertWhatsAppVideo(ctx context.Context, video *waC
 	return
 }
 
+func (mc *MessageConverter) convertWhatsAppURLPreview(ctx context.Context, msg *waConsumerApplication.ConsumerApplication_ExtendedTextMessage) *event.BeeperLinkPreview {
+	canonicalURL := msg.GetCanonicalURL()
+	if canonicalURL == "" {
+		canonicalURL = msg.GetMatchedText()
+	}
+	if canonicalURL == "" {
+		return nil
+	}
+	preview := &event.BeeperLinkPreview{
+		MatchedURL: msg.GetMatchedText(),
+		LinkPreview: event.LinkPreview{
+			CanonicalURL: canonicalURL,
+			Title:        msg.GetTitle(),
+			Description:  msg.GetDescription(),
+		},
+	}
+	if msg.GetThumbnail() == nil {
+		return preview
+	}
+	thumbnail, err := msg.DecodeThumbnail()
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Msg("Failed to decode URL preview thumbnail")
+		return preview
+	}
+	converted, err := mc.reuploadWhatsAppAttachment(ctx, thumbnail.GetIntegral().GetTransport(), whatsmeow.MediaLinkThumbnail, func(ctx context.Context, data []byte, mimeType string) ([]byte, string, string, error) {
+		return data, mimeType, "preview" + exmime.ExtensionFromMimetype(mimeType), nil
+	})
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Msg("Failed to reupload URL preview thumbnail")
+		return preview
+	}
+	preview.ImageURL = converted.Content.URL
+	preview.ImageEncryption = converted.Content.File
+	preview.ImageType = converted.Content.Info.MimeType
+	preview.ImageSize = converted.Content.Info.Size
+	preview.ImageWidth = int(thumbnail.GetAncillary().GetWidth())
+	preview.ImageHeight = int(thumbnail.GetAncillary().GetHeight())
+	return preview
+}
+
+func unfoldVCard(vcard string) []string {
+	rawLines := strings.Split(strings.ReplaceAll(vcard, "\r\n", "\n"), "\n")
+	lines := make([]string, 0, len(rawLines))
+	for _, line := range rawLines {
+		if len(lines) > 0 && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) {
+			lines[len(lines)-1] += line[1:]
+		} else if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+func summarizeVCard(vcard, fallbackName string) (name, summary string) {
+	var details []string
+	for _, line := range unfoldVCard(vcard) {
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		key, _, _ = strings.Cut(key, ";")
+		if dot := strings.IndexByte(key, '.'); dot >= 0 {
+			// Strip group prefixes like item1.TEL
+			key = key[dot+1:]
+		}
+		value = strings.TrimSpace(strings.ReplaceAll(value, `\,`, ","))
+		if value == "" {
+			continue
+		}
+		switch strings.ToUpper(key) {
+		case "FN":
+			name = value
+		case "TEL", "EMAIL":
+			details = append(details, value)
+		}
+	}
+	if name == "" {
+		name = fallbackName
+	}
+	if name == "" {
+		name = "Contact"
+	}
+	return name, strings.Join(append([]string{name}, details...), "\n")
+}
+
+func (mc *MessageConverter) convertWhatsAppContact(ctx context.Context, contact *waConsumerApplication.ConsumerApplication_ContactMessage) (*bridgev2.ConvertedMessagePart, error) {
+	transport, err := contact.Decode()
+	if err != nil {
+		return nil, err
+	}
+	vcard := transport.GetIntegral().GetVcard()
+	if downloadable := transport.GetIntegral().GetDownloadableVcard(); downloadable != nil {
+		client := ctx.Value(contextKeyWAClient).(*whatsmeow.Client)
+		data, err := client.DownloadFB(downloadable.GetIntegral(), whatsmeow.MediaDocument)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", bridgev2.ErrMediaDownloadFailed, err)
+		}
+		vcard = string(data)
+	}
+	if vcard == "" {
+		return nil, fmt.Errorf("contact message doesn't contain a vCard")
+	}
+	name, summary := summarizeVCard(vcard, transport.GetAncillary().GetDisplayName())
+	fileName := name + ".vcf"
+	intent := ctx.Value(contextKeyIntent).(bridgev2.MatrixAPI)
+	portal := ctx.Value(contextKeyPortal).(*bridgev2.Portal)
+	mxc, file, err := intent.UploadMedia(ctx, portal.MXID, []byte(vcard), fileName, "text/vcard")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", bridgev2.ErrMediaReuploadFailed, err)
+	}
+	return &bridgev2.ConvertedMessagePart{
+		Type: event.EventMessage,
+		Content: &event.MessageEventContent{
+			MsgType:  event.MsgFile,
+			Body:     summary,
+			FileName: fileName,
+			URL:      mxc,
+			File:     file,
+			Info: &event.FileInfo{
+				MimeType: "text/vcard",
+				Size:     len(vcard),
+			},
+		},
+	}, nil
+}
+
+func (mc *MessageConverter) convertWhatsAppContacts(ctx context.Context, contacts []*waConsumerApplication.ConsumerApplication_ContactMessage) []*bridgev2.ConvertedMessagePart {
+	parts := make([]*bridgev2.ConvertedMessagePart, 0, len(contacts))
+	for _, contact := range contacts {
+		converted, err := mc.convertWhatsAppContact(ctx, contact)
+		if err != nil {
+			zerolog.Ctx(ctx).Err(err).Msg("Failed to convert contact message")
+			converted = &bridgev2.ConvertedMessagePart{
+				Type: event.EventMessage,
+				Content: &event.MessageEventContent{
+					MsgType: event.MsgNotice,
+					Body:    "Failed to transfer contact\n\nPlease open in " + mc.appName(),
+				},
+			}
+		}
+		parts = append(parts, converted)
+	}
+	return parts
+}
+
 func (mc *MessageConverter) convertWhatsAppMedia(ctx context.Context, rawContent *waConsumerApplication.ConsumerApplication_Content) (converted, caption *bridgev2.ConvertedMessagePart, err error) {
 	switch content := rawContent.GetContent().(type) {
 	case *waConsumerApplication.ConsumerApplication_Content_ImageMessage:
@@ -317,7 +464,12 @@ func (mc *MessageConverter) waConsumerToMatrix(ctx context.Context, rawContent *
 		parts = append(parts, mc.WhatsAppTextToMatrix(ctx, content.MessageText))
 	case *waConsumerApplication.ConsumerApplication_Content_ExtendedTextMessage:
 		part := mc.WhatsAppTextToMatrix(ctx, content.ExtendedTextMessage.GetText())
-		// TODO convert url previews
+		if preview := mc.convertWhatsAppURLPreview(ctx, content.ExtendedTextMessage); preview != nil {
+			part.Content.BeeperLinkPreviews = []*event.BeeperLinkPreview{preview}
+			if len(part.Content.Body) == 0 {
+				part.Content.Body = preview.CanonicalURL
+			}
+		}
 		parts = append(parts, part)
 	case *waConsumerApplication.ConsumerApplication_Content_ImageMessage,
 		*waConsumerApplication.ConsumerApplication_Content_StickerMessage,
@@ -325,6 +477,11 @@ func (mc *MessageConverter) waConsumerToMatrix(ctx context.Context, rawContent *
 		*waConsumerApplication.ConsumerApplication_Content_DocumentMessage,
 		*waConsumerApplication.ConsumerApplication_Content_AudioMessage,
 		*waConsumerApplication.ConsumerApplication_Content_VideoMessage:
+		_, isViewOnce := content.(*waConsumerApplication.ConsumerApplication_Content_ViewOnceMessage)
+		if isViewOnce && !mc.shouldDownloadViewOnce() {
+			parts = append(parts, mc.viewOncePlaceholder(false))
+			break
+		}
 		converted, caption, err := mc.convertWhatsAppMedia(ctx, rawContent)
 		if err != nil {
 			zerolog.Ctx(ctx).Err(err).Msg("Failed to convert media message")
@@ -335,6 +492,10 @@ func (mc *MessageConverter) waConsumerToMatrix(ctx context.Context, rawContent *
 					Body:    "Failed to transfer media",
 				},
 			}
+		} else if isViewOnce {
+			mc.markViewOnce(converted)
+			// The warning replaces the caption, so don't leak it in a separate part either
+			caption = nil
 		}
 		parts = append(parts, converted)
 		if caption != nil {
@@ -359,21 +520,9 @@ func (mc *MessageConverter) waConsumerToMatrix(ctx context.Context, rawContent *
 			},
 		})
 	case *waConsumerApplication.ConsumerApplication_Content_ContactMessage:
-		parts = append(parts, &bridgev2.ConvertedMessagePart{
-			Type: event.EventMessage,
-			Content: &event.MessageEventContent{
-				MsgType: event.MsgNotice,
-				Body:    "Unsupported message (contact)\n\nPlease open in " + mc.appName(),
-			},
-		})
+		parts = append(parts, mc.convertWhatsAppContacts(ctx, []*waConsumerApplication.ConsumerApplication_ContactMessage{content.ContactMessage})...)
 	case *waConsumerApplication.ConsumerApplication_Content_ContactsArrayMessage:
-		parts = append(parts, &bridgev2.ConvertedMessagePart{
-			Type: event.EventMessage,
-			Content: &event.MessageEventContent{
-				MsgType: event.MsgNotice,
-				Body:    "Unsupported message (contacts array)\n\nPlease open in " + mc.appName(),
-			},
-		})
+		parts = append(parts, mc.convertWhatsAppContacts(ctx, content.ContactsArrayMessage.GetContacts())...)
 	default:
 		zerolog.Ctx(ctx).Warn().Type("content_type", content).Msg("Unrecognized content type")
 		parts = append(parts, &bridgev2.ConvertedMessagePart{
@@ -480,6 +629,13 @@ func (mc *MessageConverter) WhatsAppToMatrix(ctx context.Context, portal *bridge
 			},
 		}}
 	}
+	if setting := evt.Application.GetMetadata().GetChatEphemeralSetting(); setting.GetEphemeralExpiration() > 0 {
+		cm.Disappear = database.DisappearingSetting{
+			Type:  database.DisappearingTypeAfterRead,
+			Timer: time.Duration(setting.GetEphemeralExpiration()) * time.Second,
+		}
+	}
+	mc.applyViewOnceDisappear(cm)
 	if qm := evt.Application.GetMetadata().GetQuotedMessage(); qm != nil {
 		pcp, _ := types.ParseJID(qm.GetParticipant())
 		// TODO what if participant is not set?
@@ -18,6 +18,10 @@ package msgconv
 
 import (
 	"context"
+	"fmt"
+	"html"
+	"slices"
+	"strconv"
 	"strings"
 	"unicode/utf16"
 
@@ -49,12 +53,12 @@ func (mc *MessageConverter) MetaToMatrixText(ctx context.Context, text string, r
 	if err != nil {
 		zerolog.Ctx(ctx).Err(err).Msg("Failed to parse mentions")
 	}
-	if mentions == nil {
-		return
-	}
 	utf16Text := NewUTF16String(text)
 	prevEnd := 0
-	var output strings.Builder
+	// Mentions are replaced with placeholders before parsing formatting,
+	// so that the UTF-16 offsets are resolved against the original text.
+	var withPlaceholders strings.Builder
+	var mentionLinks []string
 	for _, mention := range mentions {
 		if mention.Offset < prevEnd {
 			zerolog.Ctx(ctx).Warn().Msg("Ignoring overlapping mentions in message")
@@ -83,16 +87,105 @@ func (mc *MessageConverter) MetaToMatrixText(ctx context.Context, text string, r
 		if mentionLink == "" {
 			continue
 		}
-		output.WriteString(utf16Text[prevEnd:mention.Offset].String())
-		output.WriteString(`<a href="`)
-		output.WriteString(mentionLink)
-		output.WriteString(`">`)
-		output.WriteString(utf16Text[mention.Offset:end].String())
-		output.WriteString(`</a>`)
+		withPlaceholders.WriteString(utf16Text[prevEnd:mention.Offset].String())
+		withPlaceholders.WriteString(mentionPlaceholder(len(mentionLinks)))
+		mentionLinks = append(mentionLinks, fmt.Sprintf(
+			`<a href="%s">%s</a>`,
+			html.EscapeString(mentionLink),
+			html.EscapeString(utf16Text[mention.Offset:end].String()),
+		))
 		prevEnd = end
 	}
-	output.WriteString(utf16Text[prevEnd:].String())
+	withPlaceholders.WriteString(utf16Text[prevEnd:].String())
+	formatted, hasFormatting := messengerMarkupToHTML(withPlaceholders.String())
+	if !hasFormatting && len(mentionLinks) == 0 {
+		return
+	}
+	for i, link := range mentionLinks {
+		formatted = strings.Replace(formatted, mentionPlaceholder(i), link, 1)
+	}
 	content.Format = event.FormatHTML
-	content.FormattedBody = output.String()
+	content.FormattedBody = formatted
 	return content
 }
+
+func mentionPlaceholder(index int) string {
+	return "\uE000" + strconv.Itoa(index) + "\uE001"
+}
+
+// mentionsToMetadata stores the mentioned text of each mention, so that the mentions can be found again in edits.
+func mentionsToMetadata(ctx context.Context, text string, rawMentions *socket.MentionData) []metaid.MessageMention {
+	mentions, err := rawMentions.Parse()
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Msg("Failed to parse mentions")
+		return nil
+	} else if len(mentions) == 0 {
+		return nil
+	}
+	utf16Text := NewUTF16String(text)
+	meta := make([]metaid.MessageMention, 0, len(mentions))
+	for _, mention := range mentions {
+		end := mention.Offset + mention.Length
+		if mention.Offset < 0 || mention.Length <= 0 || end > len(utf16Text) {
+			continue
+		}
+		meta = append(meta, metaid.MessageMention{
+			UserID: mention.ID,
+			Type:   string(mention.Type),
+			Text:   utf16Text[mention.Offset:end].String(),
+		})
+	}
+	return meta
+}
+
+// relocateMentions finds the previously mentioned texts in the edited text and builds new mention data for them.
+func relocateMentions(text string, prevMentions []metaid.MessageMention) *socket.MentionData {
+	if len(prevMentions) == 0 {
+		return nil
+	}
+	utf16Text := NewUTF16String(text)
+	var mentions socket.Mentions
+	searchFrom := 0
+	for _, mention := range prevMentions {
+		needle := NewUTF16String(mention.Text)
+		offset := indexUTF16(utf16Text[searchFrom:], needle)
+		if offset < 0 {
+			continue
+		}
+		offset += searchFrom
+		mentions = append(mentions, socket.Mention{
+			ID:     mention.UserID,
+			Offset: offset,
+			Length: len(needle),
+			Type:   socket.MentionType(mention.Type),
+		})
+		searchFrom = offset + len(needle)
+	}
+	if len(mentions) == 0 {
+		return nil
+	}
+	return mentions.ToData()
+}
+
+func indexUTF16(haystack, needle UTF16String) int {
+	if len(needle) == 0 {
+		return -1
+	}
+	for i := 0; i+len(needle) <= len(haystack); i++ {
+		if slices.Equal(haystack[i:i+len(needle)], needle) {
+			return i
+		}
+	}
+	return -1
+}
+
+// MetaEditToMatrixText converts the new text of an edited message,
+// restoring the mentions of the original message that are still present in the new text.
+func (mc *MessageConverter) MetaEditToMatrixText(ctx context.Context, text string, origMeta *metaid.MessageMetadata, portal *bridgev2.Portal) *event.MessageEventContent {
+	return mc.MetaToMatrixText(ctx, text, relocateMentions(text, origMeta.Mentions), portal)
+}
+
+// RelocateMentionData moves the mentions of one version of a message text to another version of the same message.
+func RelocateMentionData(ctx context.Context, fromText string, fromMentions *socket.MentionData, toText string) *socket.MentionData {
+	return relocateMentions(toText, mentionsToMetadata(ctx, fromText, fromMentions))
+}
@@ -17,6 +17,8 @@
 package msgconv
 
 import (
+	"time"
+
 	"maunium.net/go/mautrix/bridgev2"
 	"maunium.net/go/mautrix/format"
 
@@ -31,6 +33,11 @@ type MessageConverter struct {
 	BridgeMode  types.Platform
 	HTMLParser  *format.HTMLParser
 	DB          *metadb.MetaDB
+
+	ViewOnceMode ViewOnceMode
+	XMACacheTTL  time.Duration
+
+	xmaCache *xmaCache
 }
 
 func New(br *bridgev2.Bridge, db *metadb.MetaDB) *MessageConverter {
@@ -38,6 +45,8 @@ func New(br *bridgev2.Bridge, db *metadb.MetaDB) *MessageConverter {
 		Bridge:      br,
 		MaxFileSize: 50 * 1024 * 1024,
 		DB:          db,
+
+		xmaCache: newXMACache(),
 	}
 	mc.HTMLParser = &format.HTMLParser{
 		TabsToSpaces:   4,
@@ -21,11 +21,13 @@ import (
 	"context"
 	"fmt"
 	"image"
+	"image/jpeg"
 	"net/http"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/rs/zerolog"
 	"go.mau.fi/util/ffmpeg"
 	"go.mau.fi/whatsmeow"
 	armadillo "go.mau.fi/whatsmeow/proto"
@@ -35,6 +37,7 @@ import (
 	"go.mau.fi/whatsmeow/proto/waConsumerApplication"
 	"go.mau.fi/whatsmeow/proto/waMediaTransport"
 	"go.mau.fi/whatsmeow/proto/waMsgApplication"
+	"golang.org/x/image/draw"
 	"google.golang.org/protobuf/proto"
 	"maunium.net/go/mautrix/bridgev2"
 	"maunium.net/go/mautrix/bridgev2/database"
@@ -75,10 +78,24 @@ func (mc *MessageConverter) ToWhatsApp(
 	var armadilloContent waArmadilloApplication.Armadillo_Content
 	switch content.MsgType {
 	case event.MsgText, event.MsgNotice, event.MsgEmote:
-		waContent.Content = &waConsumerApplication.ConsumerApplication_Content_MessageText{
-			MessageText: mc.TextToWhatsApp(content),
+		if len(content.BeeperLinkPreviews) > 0 {
+			waContent.Content = &waConsumerApplication.ConsumerApplication_Content_ExtendedTextMessage{
+				ExtendedTextMessage: mc.urlPreviewToWhatsApp(ctx, mc.TextToWhatsApp(content), content.BeeperLinkPreviews[0]),
+			}
+		} else {
+			waContent.Content = &waConsumerApplication.ConsumerApplication_Content_MessageText{
+				MessageText: mc.TextToWhatsApp(content),
+			}
+		}
+	case event.MsgFile, event.MsgImage, event.MsgVideo, event.MsgAudio, event.MessageType(event.EventSticker.Type):
+		if content.MsgType == event.MsgFile && isVCardFile(content) {
+			var err error
+			waContent.Content, err = mc.vcardToWhatsApp(ctx, content)
+			if err != nil {
+				return nil, nil, err
+			}
+			break
 		}
-	case event.MsgImage, event.MsgVideo, event.MsgAudio, event.MsgFile, event.MessageType(event.EventSticker.Type):
 		reuploaded, fileName, err := mc.reuploadMediaToWhatsApp(ctx, evt, content)
 		if err != nil {
 			return nil, nil, err
@@ -93,6 +110,12 @@ func (mc *MessageConverter) ToWhatsApp(
 		if err != nil {
 			return nil, nil, err
 		}
+		if isMatrixViewOnce(evt) {
+			waContent.Content, err = wrapWhatsAppViewOnce(waContent.Content)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
 	case event.MsgLocation:
 		lat, long, err := parseGeoURI(content.GeoURI)
 		if err != nil {
@@ -129,6 +152,14 @@ func (mc *MessageConverter) ToWhatsApp(
 			}
 		}
 	}
+	if portalMeta := portal.Metadata.(*metaid.PortalMetadata); portal.Disappear.Timer > 0 || portalMeta.EphemeralSettingTS != 0 {
+		meta.Ephemeral = &waMsgApplication.MessageApplication_Metadata_ChatEphemeralSetting{
+			ChatEphemeralSetting: &waMsgApplication.MessageApplication_EphemeralSetting{
+				EphemeralExpiration:       proto.Uint32(uint32(portal.Disappear.Timer.Seconds())),
+				EphemeralSettingTimestamp: proto.Int64(portalMeta.EphemeralSettingTS),
+			},
+		}
+	}
 	if waContent.Content != nil {
 		waConsumerApp := &waConsumerApplication.ConsumerApplication{
 			Payload: &waConsumerApplication.ConsumerApplication_Payload{
@@ -154,6 +185,153 @@ func (mc *MessageConverter) ToWhatsApp(
 	}
 }
 
+func (mc *MessageConverter) urlPreviewToWhatsApp(ctx context.Context, text *waCommon.MessageText, preview *event.BeeperLinkPreview) *waConsumerApplication.ConsumerApplication_ExtendedTextMessage {
+	matchedText := preview.MatchedURL
+	if matchedText == "" {
+		matchedText = preview.CanonicalURL
+	}
+	msg := &waConsumerApplication.ConsumerApplication_ExtendedTextMessage{
+		Text:         text,
+		MatchedText:  proto.String(matchedText),
+		CanonicalURL: proto.String(preview.CanonicalURL),
+		Title:        proto.String(preview.Title),
+		Description:  proto.String(preview.Description),
+		PreviewType:  waConsumerApplication.ConsumerApplication_ExtendedTextMessage_NONE.Enum(),
+	}
+	if preview.ImageURL == "" {
+		return msg
+	}
+	thumbnail, err := mc.reuploadURLPreviewThumbnail(ctx, preview)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Msg("Failed to reupload URL preview thumbnail")
+		return msg
+	}
+	err = msg.SetThumbnail(thumbnail)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Msg("Failed to marshal URL preview thumbnail")
+	}
+	return msg
+}
+
+func (mc *MessageConverter) reuploadURLPreviewThumbnail(ctx context.Context, preview *event.BeeperLinkPreview) (*waMediaTransport.ImageTransport, error) {
+	data, err := mc.Bridge.Bot.DownloadMedia(ctx, preview.ImageURL, preview.ImageEncryption)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", bridgev2.ErrMediaDownloadFailed, err)
+	}
+	data, w, h, err := makeJPEGThumbnail(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to make thumbnail: %w", bridgev2.ErrMediaConvertFailed, err)
+	}
+	mimeType := "image/jpeg"
+	client := ctx.Value(contextKeyWAClient).(*whatsmeow.Client)
+	uploaded, err := client.Upload(ctx, data, whatsmeow.MediaLinkThumbnail)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", bridgev2.ErrMediaReuploadFailed, err)
+	}
+	return &waMediaTransport.ImageTransport{
+		Integral: &waMediaTransport.ImageTransport_Integral{
+			Transport: &waMediaTransport.WAMediaTransport{
+				Integral: &waMediaTransport.WAMediaTransport_Integral{
+					FileSHA256:        uploaded.FileSHA256,
+					MediaKey:          uploaded.MediaKey,
+					FileEncSHA256:     uploaded.FileEncSHA256,
+					DirectPath:        &uploaded.DirectPath,
+					MediaKeyTimestamp: proto.Int64(time.Now().Unix()),
+				},
+				Ancillary: &waMediaTransport.WAMediaTransport_Ancillary{
+					FileLength: proto.Uint64(uint64(len(data))),
+					Mimetype:   &mimeType,
+					Thumbnail: &waMediaTransport.WAMediaTransport_Ancillary_Thumbnail{
+						ThumbnailWidth:  proto.Uint32(uint32(w)),
+						ThumbnailHeight: proto.Uint32(uint32(h)),
+					},
+					ObjectID: &uploaded.ObjectID,
+				},
+			},
+		},
+		Ancillary: &waMediaTransport.ImageTransport_Ancillary{
+			Width:  proto.Uint32(uint32(w)),
+			Height: proto.Uint32(uint32(h)),
+		},
+	}, nil
+}
+
+func isVCardFile(content *event.MessageEventContent) bool {
+	if content.Info != nil {
+		switch content.Info.MimeType {
+		case "text/vcard", "text/x-vcard", "text/directory":
+			return true
+		}
+	}
+	fileName := content.FileName
+	if fileName == "" {
+		fileName = content.Body
+	}
+	return strings.HasSuffix(strings.ToLower(fileName), ".vcf")
+}
+
+func splitVCards(data string) []string {
+	var vcards []string
+	var current strings.Builder
+	for _, line := range strings.SplitAfter(data, "\n") {
+		trimmed := strings.ToUpper(strings.TrimSpace(line))
+		if trimmed == "BEGIN:VCARD" {
+			current.Reset()
+		}
+		current.WriteString(line)
+		if trimmed == "END:VCARD" {
+			vcards = append(vcards, strings.TrimSpace(current.String()))
+			current.Reset()
+		}
+	}
+	return vcards
+}
+
+func makeWhatsAppContact(vcard string) (*waConsumerApplication.ConsumerApplication_ContactMessage, error) {
+	name, _ := summarizeVCard(vcard, "")
+	msg := &waConsumerApplication.ConsumerApplication_ContactMessage{}
+	err := msg.Set(&waMediaTransport.ContactTransport{
+		Integral: &waMediaTransport.ContactTransport_Integral{
+			Contact: &waMediaTransport.ContactTransport_Integral_Vcard{
+				Vcard: vcard,
+			},
+		},
+		Ancillary: &waMediaTransport.ContactTransport_Ancillary{
+			DisplayName: proto.String(name),
+		},
+	})
+	return msg, err
+}
+
+func (mc *MessageConverter) vcardToWhatsApp(ctx context.Context, content *event.MessageEventContent) (waConsumerApplication.ConsumerApplication_Content_Content, error) {
+	data, err := mc.Bridge.Bot.DownloadMedia(ctx, content.URL, content.File)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", bridgev2.ErrMediaDownloadFailed, err)
+	}
+	vcards := splitVCards(string(data))
+	if len(vcards) == 0 {
+		return nil, fmt.Errorf("%w: file doesn't contain any vCards", bridgev2.ErrMediaConvertFailed)
+	}
+	contacts := make([]*waConsumerApplication.ConsumerApplication_ContactMessage, len(vcards))
+	for i, vcard := range vcards {
+		contacts[i], err = makeWhatsAppContact(vcard)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal contact: %w", err)
+		}
+	}
+	if len(contacts) == 1 {
+		return &waConsumerApplication.ConsumerApplication_Content_ContactMessage{
+			ContactMessage: contacts[0],
+		}, nil
+	}
+	return &waConsumerApplication.ConsumerApplication_Content_ContactsArrayMessage{
+		ContactsArrayMessage: &waConsumerApplication.ConsumerApplication_ContactsArrayMessage{
+			DisplayName: proto.String(fmt.Sprintf("%d contacts", len(contacts))),
+			Contacts:    contacts,
+		},
+	}, nil
+}
+
 func parseGeoURI(uri string) (lat, long float64, err error) {
 	if !strings.HasPrefix(uri, "geo:") {
 		err = fmt.Errorf("uri doesn't have geo: prefix")
@@ -172,6 +350,25 @@ func parseGeoURI(uri string) (lat, long float64, err error) {
 	return
 }
 
+// makeJPEGThumbnail downscales the given image to fit in 400x400 (like clampTo400) and encodes it as a JPEG.
+func makeJPEGThumbnail(data []byte) ([]byte, int, int, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	bounds := img.Bounds()
+	w, h := clampTo400(bounds.Dx(), bounds.Dy())
+	w, h = max(w, 1), max(h, 1)
+	thumbnail := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.ApproxBiLinear.Scale(thumbnail, thumbnail.Bounds(), img, bounds, draw.Src, nil)
+	var buf bytes.Buffer
+	err = jpeg.Encode(&buf, thumbnail, &jpeg.Options{Quality: 80})
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	return buf.Bytes(), w, h, nil
+}
+
 func clampTo400(w, h int) (int, int) {
 	if w > 400 {
 		h = h * 400 / w
@@ -0,0 +1,132 @@
+// mautrix-meta - A Matrix-Facebook Messenger and Instagram DM puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package msgconv
+
+import (
+	"fmt"
+	"time"
+
+	"go.mau.fi/whatsmeow/proto/waConsumerApplication"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/event"
+)
+
+// ViewOnceMode defines how incoming view-once media is bridged.
+type ViewOnceMode string
+
+const (
+	// ViewOnceWarn bridges view-once media normally with a caption warning about it.
+	ViewOnceWarn ViewOnceMode = "warn"
+	// ViewOnceDisappear doesn't download view-once media and bridges a notice that is deleted shortly after it's read.
+	ViewOnceDisappear ViewOnceMode = "disappear"
+	// ViewOncePlaceholder doesn't download view-once media at all and only bridges a notice.
+	ViewOncePlaceholder ViewOnceMode = "placeholder"
+)
+
+func (mode ViewOnceMode) IsValid() bool {
+	switch mode {
+	case ViewOnceWarn, ViewOnceDisappear, ViewOncePlaceholder:
+		return true
+	default:
+		return false
+	}
+}
+
+const viewOnceKey = "com.beeper.view_once"
+
+// viewOnceDisappearTimer is how long view-once placeholders are kept after being read in ViewOnceDisappear mode.
+const viewOnceDisappearTimer = 1 * time.Minute
+
+// shouldDownloadViewOnce returns true if view-once media should be bridged as-is rather than as a placeholder.
+func (mc *MessageConverter) shouldDownloadViewOnce() bool {
+	return mc.ViewOnceMode == ViewOnceWarn || mc.ViewOnceMode == ""
+}
+
+func (mc *MessageConverter) viewOncePlaceholder(expired bool) *bridgev2.ConvertedMessagePart {
+	body := fmt.Sprintf("View-once media. Open the %s to view it.", mc.appName())
+	if expired {
+		body = "Expired view-once media"
+	}
+	return &bridgev2.ConvertedMessagePart{
+		Type: event.EventMessage,
+		Content: &event.MessageEventContent{
+			MsgType: event.MsgNotice,
+			Body:    body,
+		},
+		Extra: map[string]any{
+			viewOnceKey: true,
+		},
+	}
+}
+
+func (mc *MessageConverter) markViewOnce(part *bridgev2.ConvertedMessagePart) {
+	if part.Extra == nil {
+		part.Extra = make(map[string]any)
+	}
+	part.Extra[viewOnceKey] = true
+	if part.Content.FileName == "" {
+		part.Content.FileName = part.Content.Body
+	}
+	part.Content.Body = "View-once media: the sender expects this to be viewed only once."
+	part.Content.Format = ""
+	part.Content.FormattedBody = ""
+}
+
+// applyViewOnceDisappear makes view-once placeholders disappear after being read if configured to do so.
+func (mc *MessageConverter) applyViewOnceDisappear(cm *bridgev2.ConvertedMessage) {
+	if mc.ViewOnceMode != ViewOnceDisappear || cm.Disappear.Type != "" {
+		return
+	}
+	for _, part := range cm.Parts {
+		if isViewOnce, _ := part.Extra[viewOnceKey].(bool); isViewOnce {
+			cm.Disappear = database.DisappearingSetting{
+				Type:  database.DisappearingTypeAfterRead,
+				Timer: viewOnceDisappearTimer,
+			}
+			return
+		}
+	}
+}
+
+func isMatrixViewOnce(evt *event.Event) bool {
+	isViewOnce, _ := evt.Content.Raw[viewOnceKey].(bool)
+	return isViewOnce
+}
+
+func wrapWhatsAppViewOnce(content waConsumerApplication.ConsumerApplication_Content_Content) (waConsumerApplication.ConsumerApplication_Content_Content, error) {
+	switch typedContent := content.(type) {
+	case *waConsumerApplication.ConsumerApplication_Content_ImageMessage:
+		return &waConsumerApplication.ConsumerApplication_Content_ViewOnceMessage{
+			ViewOnceMessage: &waConsumerApplication.ConsumerApplication_ViewOnceMessage{
+				ViewOnceContent: &waConsumerApplication.ConsumerApplication_ViewOnceMessage_ImageMessage{
+					ImageMessage: typedContent.ImageMessage,
+				},
+			},
+		}, nil
+	case *waConsumerApplication.ConsumerApplication_Content_VideoMessage:
+		return &waConsumerApplication.ConsumerApplication_Content_ViewOnceMessage{
+			ViewOnceMessage: &waConsumerApplication.ConsumerApplication_ViewOnceMessage{
+				ViewOnceContent: &waConsumerApplication.ConsumerApplication_ViewOnceMessage_VideoMessage{
+					VideoMessage: typedContent.VideoMessage,
+				},
+			},
+		}, nil
+	default:
+		return nil, fmt.Errorf("%w: only images and videos can be sent as view-once", bridgev2.ErrUnsupportedMessageType)
+	}
+}
@@ -0,0 +1,186 @@
+// mautrix-meta - A Matrix-Facebook Messenger and Instagram DM puppeting bridge.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package msgconv
+
+import (
+	"context"
+	"maps"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridgev2"
+
+	"go.mau.fi/mautrix-meta/pkg/messagix"
+	"go.mau.fi/mautrix-meta/pkg/messagix/data/responses"
+	"go.mau.fi/mautrix-meta/pkg/messagix/table"
+)
+
+type ttlCacheEntry[T any] struct {
+	ready   chan struct{}
+	value   T
+	err     error
+	expires time.Time
+}
+
+func (entry *ttlCacheEntry[T]) expired() bool {
+	select {
+	case <-entry.ready:
+		return time.Now().After(entry.expires)
+	default:
+		return false
+	}
+}
+
+// ttlCache is a simple in-memory cache where concurrent requests for the same key share a single fetch.
+// Errors are not cached.
+type ttlCache[K comparable, T any] struct {
+	lock      sync.Mutex
+	entries   map[K]*ttlCacheEntry[T]
+	lastPrune time.Time
+}
+
+func newTTLCache[K comparable, T any]() *ttlCache[K, T] {
+	return &ttlCache[K, T]{entries: make(map[K]*ttlCacheEntry[T])}
+}
+
+func (c *ttlCache[K, T]) pruneLocked(ttl time.Duration) {
+	if time.Since(c.lastPrune) < ttl {
+		return
+	}
+	c.lastPrune = time.Now()
+	for key, entry := range c.entries {
+		if entry.expired() {
+			delete(c.entries, key)
+		}
+	}
+}
+
+func (c *ttlCache[K, T]) Get(ctx context.Context, key K, ttl time.Duration, fetch func() (T, error)) (T, error) {
+	if ttl <= 0 {
+		return fetch()
+	}
+	c.lock.Lock()
+	entry, ok := c.entries[key]
+	if !ok || entry.expired() {
+		c.pruneLocked(ttl)
+		entry = &ttlCacheEntry[T]{ready: make(chan struct{})}
+		c.entries[key] = entry
+		c.lock.Unlock()
+		entry.value, entry.err = fetch()
+		entry.expires = time.Now().Add(ttl)
+		if entry.err != nil {
+			c.lock.Lock()
+			if c.entries[key] == entry {
+				delete(c.entries, key)
+			}
+			c.lock.Unlock()
+		}
+		close(entry.ready)
+		return entry.value, entry.err
+	}
+	c.lock.Unlock()
+	select {
+	case <-entry.ready:
+		return entry.value, entry.err
+	case <-ctx.Done():
+		var zero T
+		return zero, ctx.Err()
+	}
+}
+
+type xmaMediaKey struct {
+	ItemID    string
+	Encrypted bool
+}
+
+// xmaCache stores Instagram media fetches and their reuploads. It's shared by all logins, so that the same post
+// shared into many chats is only fetched and reuploaded once.
+type xmaCache struct {
+	media      *ttlCache[string, *responses.FetchMediaResponse]
+	reels      *ttlCache[string, *responses.ReelInfoResponse]
+	reuploaded *ttlCache[xmaMediaKey, *bridgev2.ConvertedMessagePart]
+}
+
+func newXMACache() *xmaCache {
+	return &xmaCache{
+		media:      newTTLCache[string, *responses.FetchMediaResponse](),
+		reels:      newTTLCache[string, *responses.ReelInfoResponse](),
+		reuploaded: newTTLCache[xmaMediaKey, *bridgev2.ConvertedMessagePart](),
+	}
+}
+
+func (mc *MessageConverter) fetchMediaCached(ctx context.Context, ig *messagix.InstagramMethods, mediaID, shortcode string) (*responses.FetchMediaResponse, error) {
+	return mc.xmaCache.media.Get(ctx, mediaID+"/"+shortcode, mc.XMACacheTTL, func() (*responses.FetchMediaResponse, error) {
+		return ig.FetchMedia(mediaID, shortcode)
+	})
+}
+
+func (mc *MessageConverter) fetchReelCached(ctx context.Context, ig *messagix.InstagramMethods, reelID, mediaID string) (*responses.ReelInfoResponse, error) {
+	return mc.xmaCache.reels.Get(ctx, reelID+"/"+mediaID, mc.XMACacheTTL, func() (*responses.ReelInfoResponse, error) {
+		return ig.FetchReel([]string{reelID}, mediaID)
+	})
+}
+
+func (mc *MessageConverter) fetchHighlightCached(ctx context.Context, ig *messagix.InstagramMethods, highlightID string) (*responses.ReelInfoResponse, error) {
+	return mc.xmaCache.reels.Get(ctx, highlightID+"/", mc.XMACacheTTL, func() (*responses.ReelInfoResponse, error) {
+		return ig.FetchHighlights([]string{highlightID})
+	})
+}
+
+// instagramFetchedMediaToMatrixCached reuploads fetched media, or reuses a previous reupload of the same item.
+// Whether the room is encrypted is determined from the already reuploaded preview image in minimalConverted.
+func (mc *MessageConverter) instagramFetchedMediaToMatrixCached(
+	ctx context.Context, att *table.WrappedXMA, item *responses.Items, minimalConverted *bridgev2.ConvertedMessagePart,
+) (*bridgev2.ConvertedMessagePart, error) {
+	itemID := item.ID
+	if itemID == "" {
+		itemID = item.Pk
+	}
+	if itemID == "" || (minimalConverted.Content.URL == "" && minimalConverted.Content.File == nil) {
+		return mc.instagramFetchedMediaToMatrix(ctx, att, item)
+	}
+	key := xmaMediaKey{ItemID: itemID, Encrypted: minimalConverted.Content.File != nil}
+	reused := true
+	cached, err := mc.xmaCache.reuploaded.Get(ctx, key, mc.XMACacheTTL, func() (*bridgev2.ConvertedMessagePart, error) {
+		reused = false
+		return mc.instagramFetchedMediaToMatrix(ctx, att, item)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if reused {
+		zerolog.Ctx(ctx).Debug().Str("item_id", itemID).Msg("Reusing cached XMA media reupload")
+	}
+	return cloneConvertedPart(cached), nil
+}
+
+// cloneConvertedPart copies the parts of a converted message part that are modified after conversion.
+func cloneConvertedPart(part *bridgev2.ConvertedMessagePart) *bridgev2.ConvertedMessagePart {
+	clone := *part
+	content := *part.Content
+	if content.Info != nil {
+		info := *content.Info
+		content.Info = &info
+	}
+	clone.Content = &content
+	clone.Extra = maps.Clone(part.Extra)
+	if clone.Extra == nil {
+		clone.Extra = make(map[string]any)
+	}
+	return &clone
+}